@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"image/color"
 	"image/png"
 	"log/slog"
 	"os"
@@ -28,12 +29,14 @@ func main() {
 	}
 
 	outputDir := flag.String("outputDir", ".", "Directory to write decompressed files")
-	paletteFile := flag.String("paletteFile", "", "Palette file (.PAL, .COL etc.)")
+	paletteFile := flag.String("paletteFile", "", "Palette file (.PAL, .COL etc.). Images with an embedded palette can do without")
+	transparent := flag.Int("transparent", 0, "Palette index to make transparent. -1 for opaque images")
+	conversionName := flag.String("conversion", "exact", "How palette values are scaled to 8 bits: exact, linear or legacy")
 	flag.Parse()
-	if *paletteFile == "" {
-
+	conversion, err := formats.ParsePaletteConversion(*conversionName)
+	if err != nil {
 		flag.Usage()
-		utils.ErrorAndExit("Error: Need a paletteFile to use while decompressing")
+		utils.ErrorAndExit("Error: %v", err)
 	}
 	if flag.NArg() == 0 {
 		utils.ErrorAndExit("Error: No files specified for decompression")
@@ -42,12 +45,18 @@ func main() {
 	fmt.Printf("Palette file is %s\n outputDir is %s\n Image files are %v\n", *paletteFile, *outputDir, flag.Args())
 
 	imageFiles := flag.Args()
-	paletteData, err := os.ReadFile(*paletteFile)
-	if err != nil {
-		utils.ErrorAndExit("Can't read palette file %s", *paletteFile)
+	var palette color.Palette
+	if *paletteFile != "" {
+		paletteData, err := os.ReadFile(*paletteFile)
+		if err != nil {
+			utils.ErrorAndExit("Can't read palette file %s", *paletteFile)
+		}
+		palette, err = formats.DecodePaletteWith(paletteData, conversion)
+		if err != nil {
+			utils.ErrorAndExit("Can't decode palette file %s: %v", *paletteFile, err)
+		}
+		slog.Debug("Using", "palette", *paletteFile)
 	}
-	palette := formats.DecodePalette(paletteData)
-	slog.Debug("Using", "palette", *paletteFile)
 
 	for _, imageFile := range imageFiles {
 		outputFile := utils.ImageName(imageFile, "png", *outputDir)
@@ -56,9 +65,25 @@ func main() {
 		if err != nil {
 			utils.ErrorAndExit("Can't read data file %s", imageFile)
 		}
-		decompressedData := formats.DecodeCmp(imageFile, CMPData, palette)
+		decoded, err := formats.DecodeCps(CMPData)
+		if err != nil {
+			utils.ErrorAndExit("Can't decode %s: %v", imageFile, err)
+		}
+		imagePalette := palette
+		if imagePalette == nil && decoded.Header.PaletteSize() != 0 {
+			imagePalette, err = formats.DecodePaletteWith(CMPData[10:10+decoded.Header.PaletteSize()], conversion)
+			if err != nil {
+				utils.ErrorAndExit("Can't decode palette embedded in %s: %v", imageFile, err)
+			}
+		}
+		if imagePalette == nil {
+			flag.Usage()
+			utils.ErrorAndExit("Error: %s has no embedded palette. Need a paletteFile to use while decompressing", imageFile)
+		}
 
-		img := formats.CMPToImage(decompressedData, palette, 320, 200, 1)
+		// Paletted PNGs keep the colour indices so they can be edited
+		// and compressed again with encodecmp
+		img := formats.CMPToPaletted(decoded.Pixels, imagePalette, 320, 200, *transparent)
 
 		file, err := os.Create(outputFile)
 		if err != nil {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nibrahim/eye-of-the-gopher/internal/formats"
+	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
+)
+
+// Maps img onto the colour indices of palette. Transparent pixels
+// become index 0. Paletted images are used as is without a palette.
+func toPaletted(img image.Image, palette color.Palette) (*image.Paletted, error) {
+	if p, ok := img.(*image.Paletted); ok && palette == nil {
+		return p, nil
+	}
+	if palette == nil {
+		return nil, fmt.Errorf("image is not paletted and no paletteFile was given")
+	}
+	b := img.Bounds()
+	ret := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			if _, _, _, a := c.RGBA(); a == 0 {
+				continue
+			}
+			ret.SetColorIndex(x-b.Min.X, y-b.Min.Y, uint8(palette.Index(c)))
+		}
+	}
+	return ret, nil
+}
+
+// Re-encodes an original CMP/CPS file and checks that it decodes to the same pixels
+func checkOriginal(imageFile string, relative bool) {
+	original, err := os.ReadFile(imageFile)
+	if err != nil {
+		utils.ErrorAndExit("Can't read data file %s", imageFile)
+	}
+	pixels := formats.DecodeCmp(imageFile, original, nil)
+	encoded, err := formats.EncodeCmp(pixels, relative)
+	if err != nil {
+		utils.ErrorAndExit("Could not encode %s: %v", imageFile, err)
+	}
+	status := "OK"
+	if !bytes.Equal(formats.DecodeCmp(imageFile, encoded, nil), pixels) {
+		status = "MISMATCH"
+	}
+	fmt.Printf("%-20s original %6d  encoded %6d  (%6.2f%%)  %s\n", filepath.Base(imageFile),
+		len(original), len(encoded), float64(len(encoded))*100/float64(len(original)), status)
+}
+
+func main() {
+	formats.InitLogger(formats.AssetLoaderConfig{
+		AssetLevel: slog.LevelDebug,
+		CmpLevel:   slog.LevelError,
+		MazLevel:   slog.LevelError,
+		PakLevel:   slog.LevelDebug,
+		PalLevel:   slog.LevelError,
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage : %s [options] imageFile1 imageFile2 ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nArguments:\n")
+		fmt.Fprintf(os.Stderr, "  imageFile    PNG images to compress into .CMP files. Original .CMP/.CPS files\n")
+		fmt.Fprintf(os.Stderr, "               are re-encoded and compared instead\n")
+	}
+
+	outputDir := flag.String("outputDir", ".", "Directory to write compressed files")
+	paletteFile := flag.String("paletteFile", "", "Palette file (.PAL, .COL etc.) to map non paletted images onto")
+	relative := flag.Bool("relative", false, "Use relative LCW copies")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		utils.ErrorAndExit("Error: No files specified for compression")
+	}
+
+	var palette color.Palette
+	if *paletteFile != "" {
+		paletteData, err := os.ReadFile(*paletteFile)
+		if err != nil {
+			utils.ErrorAndExit("Can't read palette file %s", *paletteFile)
+		}
+		palette = formats.DecodePalette(paletteData)
+	}
+
+	for _, imageFile := range flag.Args() {
+		switch strings.ToLower(filepath.Ext(imageFile)) {
+		case ".cmp", ".cps":
+			checkOriginal(imageFile, *relative)
+			continue
+		}
+
+		outputFile := utils.ImageName(imageFile, "cmp", *outputDir)
+		slog.Debug("Compressing", "image", imageFile, "to", outputFile)
+		file, err := os.Open(imageFile)
+		if err != nil {
+			utils.ErrorAndExit("Can't read image file %s", imageFile)
+		}
+		img, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			utils.ErrorAndExit("Could not decode %s: %v", imageFile, err)
+		}
+		paletted, err := toPaletted(img, palette)
+		if err != nil {
+			utils.ErrorAndExit("Could not convert %s: %v", imageFile, err)
+		}
+		encoded, err := formats.EncodeCmpImage(paletted, *relative)
+		if err != nil {
+			utils.ErrorAndExit("Could not encode %s: %v", imageFile, err)
+		}
+		if err := os.WriteFile(outputFile, encoded, 0644); err != nil {
+			utils.ErrorAndExit("Could not write %s: %v", outputFile, err)
+		}
+	}
+}
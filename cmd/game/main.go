@@ -6,6 +6,8 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/nibrahim/eye-of-the-gopher/internal/engine"
@@ -33,16 +35,24 @@ func main() {
 
 	}
 	scale := flag.Float64("scale", 4.0, "Scaling for all assets")
-	extraAssetDir := flag.String("extraAssetDir", "", "Directory to side load extra assets")
+	extraAssetDir := flag.String("extraAssetDir", "", "Directory or .zip file to side load extra assets from")
 	enhanced := flag.Bool("enhanced", false, "Use Side loaded enhanced assets")
+	watch := flag.Bool("watch", false, "Reload side loaded assets when they change (for development). Not for .zip files")
 	flag.Parse()
 
 	if flag.NArg() == 0 {
 		utils.ErrorAndExit("Error: No EOB origin asset directory specified")
 	}
 
+	if *watch && strings.EqualFold(filepath.Ext(*extraAssetDir), ".zip") {
+		utils.ErrorAndExit("Error: -watch can't reload assets from a .zip file. Unpack %s and side load the directory instead", *extraAssetDir)
+	}
+
 	assetDir := flag.Args()[0]
-	game := engine.NewGame(assetDir, *extraAssetDir, *enhanced)
+	game, err := engine.NewGame(assetDir, *extraAssetDir, *enhanced, *watch)
+	if err != nil {
+		utils.ErrorAndExit("Error: %v", err)
+	}
 
 	sw := int(float64(engine.ScreenWidth) * *scale)
 	sh := int(float64(engine.ScreenHeight) * *scale)
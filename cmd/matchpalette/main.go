@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nibrahim/eye-of-the-gopher/internal/formats"
+	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
+)
+
+// Writes imageName drawn with palette into dir so the candidates can be
+// compared by eye
+func writePreview(assets *formats.Assets, imageName string, paletteName string, dir string) error {
+	lookup := paletteName
+	if paletteName == formats.EmbeddedPaletteName {
+		lookup = ""
+	}
+	sprite, err := assets.GetSpriteWithOptions(imageName, lookup, 320, 200, "", formats.SpriteOptions{Transparent: formats.NoTransparency})
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(filepath.Base(imageName), filepath.Ext(imageName))
+	paletteBase := strings.TrimSuffix(filepath.Base(paletteName), filepath.Ext(paletteName))
+	if paletteName == formats.EmbeddedPaletteName {
+		paletteBase = "embedded"
+	}
+	file, err := os.Create(filepath.Join(dir, strings.ToLower(base+"-"+paletteBase+".png")))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return png.Encode(file, sprite.Image)
+}
+
+func main() {
+	formats.InitLogger(formats.AssetLoaderConfig{
+		AssetLevel: slog.LevelError,
+		CmpLevel:   slog.LevelError,
+		MazLevel:   slog.LevelError,
+		PakLevel:   slog.LevelError,
+		PalLevel:   slog.LevelError,
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage : %s [options] assetDirectory imageName1 imageName2 ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nArguments:\n")
+		fmt.Fprintf(os.Stderr, "  assetDirectory    Directory with original EOB .pak files (6 of them)\n")
+		fmt.Fprintf(os.Stderr, "  imageName         CMP or CPS images in the assets to find palettes for\n")
+	}
+	extraAssetDir := flag.String("extraAssetDir", "", "Directory or .zip file to side load extra assets and palettes from")
+	top := flag.Int("n", 5, "Number of palettes to list for each image")
+	previewDir := flag.String("previewDir", "", "Directory to write the image drawn with each listed palette")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		utils.ErrorAndExit("Error: Need an asset directory and at least one image")
+	}
+
+	assets, err := formats.LoadAssets(flag.Arg(0), *extraAssetDir)
+	if err != nil {
+		utils.ErrorAndExit("Error: %v", err)
+	}
+	defer assets.Close()
+
+	for _, imageName := range flag.Args()[1:] {
+		matches, err := assets.MatchPalettes(imageName)
+		if err != nil {
+			utils.ErrorAndExit("Error: %v", err)
+		}
+		fmt.Printf("%s\n", imageName)
+		fmt.Printf("  %-4s %-16s %6s %10s %8s\n", "Rank", "Palette", "Score", "Smoothness", "Coverage")
+		for i, match := range matches[:min(*top, len(matches))] {
+			fmt.Printf("  %-4d %-16s %6.3f %10.3f %8.3f\n", i+1, match.Name, match.Score, match.Smoothness, match.Coverage)
+			if *previewDir != "" {
+				if err := writePreview(assets, imageName, match.Name, *previewDir); err != nil {
+					utils.ErrorAndExit("Could not write preview: %v", err)
+				}
+			}
+		}
+	}
+}
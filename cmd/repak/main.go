@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nibrahim/eye-of-the-gopher/internal/formats"
+	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
+)
+
+func main() {
+	formats.InitLogger(formats.AssetLoaderConfig{
+		AssetLevel: slog.LevelDebug,
+		CmpLevel:   slog.LevelError,
+		MazLevel:   slog.LevelError,
+		PakLevel:   slog.LevelDebug,
+		PalLevel:   slog.LevelError,
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage : %s [options] outputPak file1 file2 ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nArguments:\n")
+		fmt.Fprintf(os.Stderr, "  outputPak    PAK file to create\n")
+		fmt.Fprintf(os.Stderr, "  file         Files to add. Entries are named after the upper cased file name and replace entries of the base PAK\n")
+	}
+	basePak := flag.String("base", "", "Original PAK file to start from. Entry order and header layout are kept")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		utils.ErrorAndExit("Error: No output PAK file specified")
+	}
+
+	archive := formats.NewPakArchive()
+	if *basePak != "" {
+		var err error
+		archive, err = formats.ReadPak(*basePak)
+		if err != nil {
+			utils.ErrorAndExit("Could not read base PAK file: %v", err)
+		}
+	}
+
+	for _, file := range flag.Args()[1:] {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			utils.ErrorAndExit("Can't read data file %s", file)
+		}
+		archive.Set(strings.ToUpper(filepath.Base(file)), data)
+	}
+
+	err := archive.WritePakFile(flag.Arg(0))
+	if err != nil {
+		utils.ErrorAndExit("Could not write PAK file: %v", err)
+	}
+}
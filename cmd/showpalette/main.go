@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
@@ -8,6 +10,8 @@ import (
 	"image/png"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/nibrahim/eye-of-the-gopher/internal/formats"
 	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
@@ -16,7 +20,18 @@ import (
 	"golang.org/x/image/math/fixed"
 )
 
-func debugPalette(palette color.Palette, filename string) error {
+// Extra information drawn on the swatches
+type swatchNotes struct {
+	counts  []int         // How many pixels use each index. nil to leave out
+	compare color.Palette // Palette to show next to each colour that differs from it. nil to leave out
+}
+
+var (
+	unusedColour = color.RGBA{255, 0, 0, 255}
+	differColour = color.RGBA{0, 0, 255, 255}
+)
+
+func debugPalette(palette color.Palette, filename string, notes swatchNotes) error {
 	const (
 		columns      = 8
 		rows         = 32
@@ -49,6 +64,23 @@ func debugPalette(palette color.Palette, filename string) error {
 		swatchRect := image.Rect(x+textWidth, y, x+textWidth+swatchWidth, y+swatchHeight)
 		draw.Draw(img, swatchRect, &image.Uniform{col}, image.Point{}, draw.Src)
 
+		// Colours that differ get the other palette's colour in the right half
+		if differs(palette, notes.compare, i) {
+			otherRect := image.Rect(x+textWidth+swatchWidth/2, y, x+textWidth+swatchWidth, y+swatchHeight)
+			if i < len(notes.compare) {
+				draw.Draw(img, otherRect, &image.Uniform{notes.compare[i]}, image.Point{}, draw.Src)
+			}
+			outline(img, swatchRect, differColour)
+		}
+
+		if notes.counts != nil {
+			if notes.counts[i] == 0 {
+				outline(img, swatchRect.Inset(1), unusedColour)
+			} else {
+				drawText(img, fmt.Sprintf("%d", notes.counts[i]), x+textWidth+4, y+swatchHeight/2+3, contrasting(col))
+			}
+		}
+
 		// Draw index text
 		drawText(img, fmt.Sprintf("%3d", i), x+2, y+swatchHeight/2+3, color.RGBA{0, 0, 0, 255})
 	}
@@ -63,6 +95,103 @@ func debugPalette(palette color.Palette, filename string) error {
 	return png.Encode(file, img)
 }
 
+// Whether entry i of palette differs from compare
+func differs(palette color.Palette, compare color.Palette, i int) bool {
+	if compare == nil {
+		return false
+	}
+	if i >= len(compare) || i >= len(palette) {
+		return true
+	}
+	r1, g1, b1, a1 := palette[i].RGBA()
+	r2, g2, b2, a2 := compare[i].RGBA()
+	return r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2
+}
+
+// Draws a 2 pixel border just inside rect
+func outline(img *image.RGBA, rect image.Rectangle, col color.RGBA) {
+	for _, edge := range []image.Rectangle{
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+2),
+		image.Rect(rect.Min.X, rect.Max.Y-2, rect.Max.X, rect.Max.Y),
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+2, rect.Max.Y),
+		image.Rect(rect.Max.X-2, rect.Min.Y, rect.Max.X, rect.Max.Y),
+	} {
+		draw.Draw(img, edge, &image.Uniform{col}, image.Point{}, draw.Src)
+	}
+}
+
+// Black or white, whichever reads better on col
+func contrasting(col color.Color) color.RGBA {
+	r, g, b, _ := col.RGBA()
+	if 299*r+587*g+114*b > 1000*0x8000 {
+		return color.RGBA{0, 0, 0, 255}
+	}
+	return color.RGBA{255, 255, 255, 255}
+}
+
+// Formats indices as ranges like "0-15, 32, 40-47"
+func indexRanges(indices []int) string {
+	parts := []string{}
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprintf("%d", indices[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indices[i], indices[j]))
+		}
+		i = j + 1
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Counts how many pixels of the CMP/CPS images use each index
+func countIndices(imageFiles []string) ([]int, error) {
+	counts := make([]int, 256)
+	for _, imageFile := range imageFiles {
+		data, err := os.ReadFile(imageFile)
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := formats.DecodeCps(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", imageFile, err)
+		}
+		for _, p := range decoded.Pixels {
+			counts[p]++
+		}
+	}
+	return counts, nil
+}
+
+// Prints what the swatch shows for use in notes
+func printSummary(palette color.Palette, notes swatchNotes) {
+	if notes.counts != nil {
+		unused := []int{}
+		for i, n := range notes.counts {
+			if n == 0 {
+				unused = append(unused, i)
+			}
+		}
+		fmt.Printf("Used indices   : %d\n", 256-len(unused))
+		fmt.Printf("Unused indices : %s\n", indexRanges(unused))
+	}
+	if notes.compare != nil {
+		different := []int{}
+		for i := range max(len(palette), len(notes.compare)) {
+			if differs(palette, notes.compare, i) {
+				different = append(different, i)
+			}
+		}
+		fmt.Printf("Differing      : %s\n", indexRanges(different))
+	}
+}
+
 func drawText(img *image.RGBA, text string, x, y int, col color.RGBA) {
 	point := fixed.Point26_6{
 		X: fixed.Int26_6(x * 64),
@@ -78,6 +207,72 @@ func drawText(img *image.RGBA, text string, x, y int, col color.RGBA) {
 	d.DrawString(text)
 }
 
+// Reads a palette in any of the supported formats. Text formats are
+// recognised by their header and anything else that isn't a .act file
+// is taken to be a VGA .COL/.PAL file.
+func readPalette(file string, conversion formats.PaletteConversion) (color.Palette, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("JASC-PAL")):
+		return formats.DecodeJASCPalette(data)
+	case bytes.HasPrefix(data, []byte("GIMP Palette")):
+		return formats.DecodeGIMPPalette(data)
+	case strings.ToLower(filepath.Ext(file)) == ".act":
+		return formats.DecodeACTPalette(data)
+	}
+	return formats.DecodePaletteWith(data, conversion)
+}
+
+// Output format for a file name when none is given
+func formatFor(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".gpl":
+		return "gpl"
+	case ".act":
+		return "act"
+	case ".pal":
+		return "jasc"
+	}
+	return "col"
+}
+
+func writePalette(file string, format string, palette color.Palette, conversion formats.PaletteConversion) error {
+	var data []byte
+	switch format {
+	case "col":
+		data = formats.EncodePalette(palette, conversion)
+	case "jasc":
+		data = formats.EncodeJASCPalette(palette)
+	case "gpl":
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		data = formats.EncodeGIMPPalette(palette, name)
+	case "act":
+		data = formats.EncodeACTPalette(palette)
+	default:
+		return fmt.Errorf("unknown palette format %s. Use col, jasc, gpl or act", format)
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage : %s swatch [options] paletteFile outputImageFile [imageFile ...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "        %s convert [options] inputPalette outputPalette\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "  swatch     Draw the colours of a palette with their indices into a PNG. With images, each\n")
+	fmt.Fprintf(os.Stderr, "             colour shows how many pixels use it and unused ones are outlined in red.\n")
+	fmt.Fprintf(os.Stderr, "             With -compare, colours that differ are outlined in blue with the other\n")
+	fmt.Fprintf(os.Stderr, "             palette's colour in the right half\n")
+	fmt.Fprintf(os.Stderr, "  convert    Convert between VGA .COL/.PAL, JASC-PAL, GIMP .gpl and Adobe .act palettes\n")
+	fmt.Fprintf(os.Stderr, "\nArguments:\n")
+	fmt.Fprintf(os.Stderr, "  paletteFile     Palette in any of the supported formats\n")
+	fmt.Fprintf(os.Stderr, "  imageFile       CMP/CPS images to count colour index usage over\n")
+	fmt.Fprintf(os.Stderr, "  outputPalette   Format goes by extension: .col (VGA), .pal (JASC-PAL), .gpl or .act unless -format is given\n")
+	fmt.Fprintf(os.Stderr, "\nRun %s command -h for the options of a command\n", os.Args[0])
+}
+
 func main() {
 	formats.InitLogger(formats.AssetLoaderConfig{
 		AssetLevel: slog.LevelDebug,
@@ -86,16 +281,67 @@ func main() {
 		PakLevel:   slog.LevelDebug,
 		PalLevel:   slog.LevelError,
 	})
-	if len(os.Args) != 3 {
-		utils.ErrorAndExit("Usage: ./showpalette dataFile paletteFile ouputImageFile")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		utils.ErrorAndExit("Error: No command given")
 	}
 
-	paletteFile := os.Args[1]
-	opFile := os.Args[2]
-
-	paletteData, _ := os.ReadFile(paletteFile)
-	palette := formats.DecodePalette(paletteData)
+	command, args := flag.Arg(0), flag.Args()[1:]
+	if command != "swatch" && command != "convert" && len(flag.Args()) == 2 {
+		// The old form with just a palette and an image
+		command, args = "swatch", flag.Args()
+	}
+	if command != "swatch" && command != "convert" {
+		usage()
+		utils.ErrorAndExit("Error: Unknown command %s", command)
+	}
+	commandFlags := flag.NewFlagSet(command, flag.ExitOnError)
+	conversionName := commandFlags.String("conversion", "exact", "How VGA palette values are scaled to 8 bits: exact, linear or legacy")
+	format := commandFlags.String("format", "", "Output format for convert: col, jasc, gpl or act")
+	compareFile := commandFlags.String("compare", "", "Palette to compare with for swatch")
+	commandFlags.Parse(args)
+	conversion, err := formats.ParsePaletteConversion(*conversionName)
+	if err != nil {
+		utils.ErrorAndExit("Error: %v", err)
+	}
+	if commandFlags.NArg() < 2 || (command == "convert" && commandFlags.NArg() != 2) {
+		usage()
+		utils.ErrorAndExit("Error: %s needs an input and an output file", command)
+	}
+	input, output := commandFlags.Arg(0), commandFlags.Arg(1)
 
-	debugPalette(palette, opFile)
+	palette, err := readPalette(input, conversion)
+	if err != nil {
+		utils.ErrorAndExit("Can't read palette file %s: %v", input, err)
+	}
 
+	switch command {
+	case "swatch":
+		notes := swatchNotes{}
+		if *compareFile != "" {
+			notes.compare, err = readPalette(*compareFile, conversion)
+			if err != nil {
+				utils.ErrorAndExit("Can't read palette file %s: %v", *compareFile, err)
+			}
+		}
+		if commandFlags.NArg() > 2 {
+			notes.counts, err = countIndices(commandFlags.Args()[2:])
+			if err != nil {
+				utils.ErrorAndExit("Can't count colour usage: %v", err)
+			}
+		}
+		if err := debugPalette(palette, output, notes); err != nil {
+			utils.ErrorAndExit("Could not write swatch: %v", err)
+		}
+		printSummary(palette, notes)
+	case "convert":
+		if *format == "" {
+			*format = formatFor(output)
+		}
+		if err := writePalette(output, *format, palette, conversion); err != nil {
+			utils.ErrorAndExit("Could not write palette: %v", err)
+		}
+	}
 }
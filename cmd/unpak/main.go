@@ -1,32 +1,194 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/nibrahim/eye-of-the-gopher/internal/formats"
 	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
 )
 
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Offset uint32 `json:"offset"`
+	Size   int    `json:"size"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+type ManifestArchive struct {
+	File      string          `json:"file"`
+	Size      int             `json:"size"`
+	Variant   string          `json:"variant"`
+	BigEndian bool            `json:"bigEndian"`
+	MD5       string          `json:"md5"`
+	SHA256    string          `json:"sha256"`
+	Entries   []ManifestEntry `json:"entries"`
+}
+
+type Manifest struct {
+	Archives []ManifestArchive `json:"archives"`
+}
+
+func checksums(data []byte) (string, string) {
+	m := md5.Sum(data)
+	s := sha256.Sum256(data)
+	return hex.EncodeToString(m[:]), hex.EncodeToString(s[:])
+}
+
+// Checks name against the glob patterns. No patterns matches
+// everything.
+func selected(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the second argument is the output directory of the older
+// "unpak pakFile outputDirectory" form. That's anything that isn't a
+// file and isn't named like a PAK file.
+func isOutputDir(arg string) bool {
+	info, err := os.Stat(arg)
+	if err == nil {
+		return info.IsDir()
+	}
+	return !strings.EqualFold(filepath.Ext(arg), ".pak")
+}
+
 func main() {
 	formats.InitLogger(formats.AssetLoaderConfig{
 		AssetLevel: slog.LevelDebug,
 		CmpLevel:   slog.LevelError,
 		MazLevel:   slog.LevelError,
-		PakLevel:   slog.LevelDebug,
+		PakLevel:   slog.LevelInfo,
 		PalLevel:   slog.LevelError,
 	})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage : %s [options] pakFile1 pakFile2 ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s pakFile outputDirectory\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nArguments:\n")
+		fmt.Fprintf(os.Stderr, "  pakFile            PAK files to list or extract\n")
+		fmt.Fprintf(os.Stderr, "  outputDirectory    Same as -outputDir. Only when there's a single PAK file\n")
+	}
+
+	var patterns []string
+	outputDir := flag.String("outputDir", ".", "Directory to extract entries into")
+	list := flag.Bool("list", false, "List entries with their offsets and sizes instead of extracting them")
+	manifestFile := flag.String("manifest", "", "Write a JSON manifest with checksums of the archives and selected entries to this file")
+	flag.Func("include", "Only use entries matching this glob (e.g. '*.CMP'). Can be repeated", func(s string) error {
+		if _, err := path.Match(s, ""); err != nil {
+			return err
+		}
+		patterns = append(patterns, s)
+		return nil
+	})
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		utils.ErrorAndExit("Error: No PAK files specified")
+	}
 
-	if len(os.Args) != 3 {
-		utils.ErrorAndExit("Usage: unpak pakfile outputDirectory")
+	pakFiles := flag.Args()
+	if len(pakFiles) == 2 && isOutputDir(pakFiles[1]) {
+		outputDirSet := false
+		flag.Visit(func(f *flag.Flag) {
+			outputDirSet = outputDirSet || f.Name == "outputDir"
+		})
+		if outputDirSet {
+			utils.ErrorAndExit("Error: %s is a directory, not a PAK file. Use either -outputDir or an output directory argument", pakFiles[1])
+		}
+		*outputDir = pakFiles[1]
+		pakFiles = pakFiles[:1]
 	}
 
-	assets := formats.NewAssets()
-	err := assets.LoadPakFile(os.Args[1], "")
-	if err != nil {
-		utils.ErrorAndExit("Could not unpack file: %v", err)
+	manifest := Manifest{Archives: []ManifestArchive{}}
+	extracted := make(map[string]string)
+
+	for _, pakFile := range pakFiles {
+		raw, err := os.ReadFile(pakFile)
+		if err != nil {
+			utils.ErrorAndExit("Can't read PAK file %s: %v", pakFile, err)
+		}
+		archive, err := formats.ParsePak(bytes.NewReader(raw), int64(len(raw)))
+		if err != nil {
+			utils.ErrorAndExit("Could not unpack %s: %v", pakFile, err)
+		}
+
+		md5sum, sha256sum := checksums(raw)
+		entry := ManifestArchive{
+			File:      filepath.Base(pakFile),
+			Size:      len(raw),
+			Variant:   archive.Variant.String(),
+			BigEndian: archive.BigEndian,
+			MD5:       md5sum,
+			SHA256:    sha256sum,
+			Entries:   []ManifestEntry{},
+		}
+
+		if *list {
+			fmt.Printf("%s (%s, %d entries)\n", pakFile, archive.Variant, len(archive.Entries))
+		}
+		for _, e := range archive.Entries {
+			if !selected(patterns, e.Name) {
+				continue
+			}
+			md5sum, sha256sum := checksums(e.Data)
+			entry.Entries = append(entry.Entries, ManifestEntry{
+				Name:   e.Name,
+				Offset: e.Offset,
+				Size:   len(e.Data),
+				MD5:    md5sum,
+				SHA256: sha256sum,
+			})
+
+			if *list {
+				fmt.Printf("  %-14s %10d %10d\n", e.Name, e.Offset, len(e.Data))
+				continue
+			}
+			if previous, exists := extracted[strings.ToUpper(e.Name)]; exists {
+				formats.PakLogger.Warn("Overwriting extracted entry", "name", e.Name, "from", previous, "with", pakFile)
+			}
+			extracted[strings.ToUpper(e.Name)] = pakFile
+			if err := os.MkdirAll(*outputDir, 0755); err != nil {
+				utils.ErrorAndExit("Could not create %s: %v", *outputDir, err)
+			}
+			if !filepath.IsLocal(e.Name) {
+				utils.ErrorAndExit("Refusing to extract %s from %s outside %s", e.Name, pakFile, *outputDir)
+			}
+			opfile := filepath.Join(*outputDir, e.Name)
+			if err := os.WriteFile(opfile, e.Data, 0644); err != nil {
+				utils.ErrorAndExit("Could not write %s: %v", opfile, err)
+			}
+		}
+		manifest.Archives = append(manifest.Archives, entry)
 	}
-	opdir := os.Args[2]
-	assets.WriteAssetData(opdir)
 
+	if *manifestFile != "" {
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			utils.ErrorAndExit("Could not create manifest: %v", err)
+		}
+		if err := os.WriteFile(*manifestFile, append(data, '\n'), 0644); err != nil {
+			utils.ErrorAndExit("Could not write manifest %s: %v", *manifestFile, err)
+		}
+	}
 }
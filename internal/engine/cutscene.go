@@ -2,6 +2,8 @@ package engine
 
 import (
 	"image"
+	"path"
+	"strings"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/nibrahim/eye-of-the-gopher/internal/formats"
@@ -40,24 +42,69 @@ func NewCutSceneManager(assets *formats.Assets) (*CutSceneManager, error) {
 		subtitles:  subtitles,
 	}
 
-	sm0, err := NewScene0(csm)
-	sm1, err := NewScene1(csm)
-	sm2, err := NewScene2(csm)
-	sm3, err := NewScene3(csm)
-	sm4, err := NewScene4(csm)
-
-	if err != nil {
+	if err := csm.loadScenes(); err != nil {
 		return nil, err
 	}
-	csm.scene0 = sm0
-	csm.scene1 = sm1
-	csm.scene2 = sm2
-	csm.scene3 = sm3
-	csm.scene4 = sm4
 	return csm, nil
 
 }
 
+// Builds all the scenes from the assets. Scenes start from the
+// beginning.
+func (c *CutSceneManager) loadScenes() error {
+	sm0, err := NewScene0(c)
+	if err != nil {
+		return err
+	}
+	sm1, err := NewScene1(c)
+	if err != nil {
+		return err
+	}
+	sm2, err := NewScene2(c)
+	if err != nil {
+		return err
+	}
+	sm3, err := NewScene3(c)
+	if err != nil {
+		return err
+	}
+	sm4, err := NewScene4(c)
+	if err != nil {
+		return err
+	}
+	c.scene0 = sm0
+	c.scene1 = sm1
+	c.scene2 = sm2
+	c.scene3 = sm3
+	c.scene4 = sm4
+	return nil
+}
+
+// Rebuilds the subtitles and scenes if any image or palette in
+// changed. The current scene restarts with the new images.
+func (c *CutSceneManager) reloadAssets(changed map[string]bool) {
+	needed := false
+	for name := range changed {
+		switch strings.ToLower(path.Ext(name)) {
+		case ".cmp", ".cps", ".png", ".col", ".pal":
+			needed = true
+		}
+	}
+	if !needed {
+		return
+	}
+	subtitles, err := loadSubtitles(c.assets)
+	if err != nil {
+		EngineLogger.Warn("Couldn't reload subtitles", "error", err)
+		return
+	}
+	c.subtitles = subtitles
+	c.subtitle = nil
+	if err := c.loadScenes(); err != nil {
+		EngineLogger.Warn("Couldn't reload cutscenes", "error", err)
+	}
+}
+
 func (c *CutSceneManager) Update(game *Game) (bool, error) {
 	c.frameCntr += 1
 	if c.frameCntr == c.frameDelay {
@@ -16,7 +16,7 @@ type Scene0 struct {
 }
 
 func NewScene0(c *CutSceneManager) (*Scene0, error) {
-	titleCard, err := c.assets.GetSprite("INTRO.CPS", "EOBPAL.COL", 320, 200, "")
+	titleCard, err := c.assets.GetSpriteWithOptions("INTRO.CPS", "EOBPAL.COL", 320, 200, "", opaque)
 	if err != nil {
 		EngineLogger.Error("Couldn't load  title card sprite", "sprite", "INTRO.CPS")
 		return nil, err
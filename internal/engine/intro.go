@@ -7,10 +7,15 @@ import (
 	"github.com/nibrahim/eye-of-the-gopher/internal/formats"
 )
 
+// Full screen images shouldn't have holes wherever colour 0 is used
+var opaque = formats.SpriteOptions{Transparent: formats.NoTransparency}
+
 type ImageStage struct { // This will later become an interface
 	startedAt   time.Time
 	running     bool
 	name        string
+	assetName   string
+	paletteName string
 	image       *formats.Sprite
 	fadeStart   time.Duration
 	displayTime time.Duration
@@ -20,12 +25,14 @@ type ImageStage struct { // This will later become an interface
 }
 
 func NewImageStage(assets *formats.Assets, name string, assetName string, paletteName string, trackName string, displayDuration int, fadeDuration int) (*ImageStage, error) {
-	image, err := assets.GetSprite(assetName, paletteName, 320, 200, "")
+	image, err := assets.GetSpriteWithOptions(assetName, paletteName, 320, 200, "", opaque)
 	if err != nil {
 		return nil, err
 	}
 	ret := ImageStage{
 		name:         name,
+		assetName:    assetName,
+		paletteName:  paletteName,
 		image:        image,
 		displayTime:  time.Duration(displayDuration) * time.Second,
 		fadeStart:    time.Duration(fadeDuration) * time.Second,
@@ -101,6 +108,23 @@ func (i *IntroManager) Draw(screen *ebiten.Image, game *Game) {
 	}
 }
 
+// Reloads the images of stages whose image or palette is in changed
+func (i *IntroManager) reloadAssets(assets *formats.Assets, changed map[string]bool) {
+	for idx := range i.stages {
+		stage := &i.stages[idx]
+		if !changed[formats.NormaliseName(stage.assetName)] && !changed[formats.NormaliseName(stage.paletteName)] {
+			continue
+		}
+		image, err := assets.GetSpriteWithOptions(stage.assetName, stage.paletteName, 320, 200, "", opaque)
+		if err != nil {
+			EngineLogger.Warn("Couldn't reload stage image", "stage", stage.name, "asset", stage.assetName, "error", err)
+			continue
+		}
+		EngineLogger.Debug("Reloaded stage image", "stage", stage.name, "asset", stage.assetName)
+		stage.image = image
+	}
+}
+
 func NewIntroManager(assets *formats.Assets, enhanced bool) *IntroManager {
 	type SceneConfig struct {
 		name, asset, palette, trackname string
@@ -3,6 +3,7 @@ package engine
 import (
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/audio"
@@ -46,18 +47,29 @@ type Game struct {
 	cutSceneManager *CutSceneManager
 
 	// Assets used in the game
-	assets formats.Assets
+	assets *formats.Assets
+
+	// Development mode where sideloaded assets are polled for changes
+	watch    bool
+	lastPoll time.Time
 }
 
-func NewGame(assetDir string, extraAssetDir string, enhanced bool) Game {
+// How often sideloaded assets are checked for changes in watch mode
+const assetPollInterval = time.Second
+
+func NewGame(assetDir string, extraAssetDir string, enhanced bool, watch bool) (Game, error) {
 	EngineLogger.Debug("Creating game")
-	assets := formats.LoadAssets(assetDir, extraAssetDir)
+	assets, err := formats.LoadAssets(assetDir, extraAssetDir)
+	if err != nil {
+		return Game{}, err
+	}
 	audioContext := audio.NewContext(44100)
 
 	introManager := NewIntroManager(assets, enhanced)
 	cutsceneManager, err := NewCutSceneManager(assets)
 	if err != nil {
-		panic(err)
+		assets.Close()
+		return Game{}, err
 	}
 
 	return Game{
@@ -65,9 +77,10 @@ func NewGame(assetDir string, extraAssetDir string, enhanced bool) Game {
 		cutSceneManager: cutsceneManager,
 		state:           GameIntro,
 		// state:        GameCutScene,
-		assets:       *assets,
+		assets:       assets,
 		audioContext: audioContext,
-	}
+		watch:        watch,
+	}, nil
 
 }
 
@@ -95,7 +108,42 @@ func (g *Game) EnsureTrackPlaying(trackname string) {
 	}
 }
 
+// Checks sideloaded assets for changes and gets everything built from
+// them rebuilt so that the new versions show up on the next frame
+func (g *Game) pollAssets() {
+	if time.Since(g.lastPoll) < assetPollInterval {
+		return
+	}
+	g.lastPoll = time.Now()
+	changed, err := g.assets.Reload()
+	if err != nil {
+		EngineLogger.Warn("Couldn't check assets for changes", "error", err)
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	EngineLogger.Info("Reloading changed assets", "names", changed)
+	changedSet := make(map[string]bool)
+	for _, name := range changed {
+		changedSet[name] = true
+	}
+
+	if g.currentTrackName != "" && changedSet[formats.NormaliseName(g.currentTrackName)] {
+		if g.currentTrack != nil {
+			g.currentTrack.Close()
+			g.currentTrack = nil
+		}
+		g.currentTrackName = "" // EnsureTrackPlaying will start the new version
+	}
+	g.introManager.reloadAssets(g.assets, changedSet)
+	g.cutSceneManager.reloadAssets(changedSet)
+}
+
 func (g *Game) Update() error {
+	if g.watch {
+		g.pollAssets()
+	}
 	switch g.state {
 	case GameIntro:
 		next, _ := g.introManager.Update(g)
@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"image"
+	"image/color"
+	"slices"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// Palette effects the way the original game does them. Fades step the
+// palette towards black or another palette and water and fire are
+// animated by rotating ranges of entries.
+
+// Blends a and b. t runs from 0 (a) to 1 (b). Entries missing from the
+// shorter palette are taken to be transparent.
+func LerpPalette(a, b color.Palette, t float64) color.Palette {
+	t = min(max(t, 0), 1)
+	ret := make(color.Palette, max(len(a), len(b)))
+	for i := range ret {
+		var ar, ag, ab, aa, br, bg, bb, ba uint32
+		if i < len(a) {
+			ar, ag, ab, aa = a[i].RGBA()
+		}
+		if i < len(b) {
+			br, bg, bb, ba = b[i].RGBA()
+		}
+		mix := func(x, y uint32) uint8 {
+			return uint8((float64(x)+(float64(y)-float64(x))*t)/257 + 0.5)
+		}
+		ret[i] = color.RGBA{mix(ar, br), mix(ag, bg), mix(ab, bb), mix(aa, ba)}
+	}
+	return ret
+}
+
+// The palette p fades to. Every entry is black but keeps its alpha so
+// transparent colours stay transparent.
+func BlackPalette(p color.Palette) color.Palette {
+	ret := make(color.Palette, len(p))
+	for i, c := range p {
+		_, _, _, a := c.RGBA()
+		if a == 0 {
+			ret[i] = color.RGBA{}
+		} else {
+			ret[i] = color.RGBA{0, 0, 0, uint8(a >> 8)}
+		}
+	}
+	return ret
+}
+
+// A range of palette entries that rotates by one entry every Interval
+type ColourCycle struct {
+	First    int // First and last entries of the range, inclusive
+	Last     int
+	Interval time.Duration
+	Reverse  bool // Rotate towards First rather than Last
+}
+
+// How many entries cycle has rotated by after elapsed. 0 for ranges
+// that don't fit p.
+func cycleShift(p color.Palette, cycle ColourCycle, elapsed time.Duration) int {
+	if cycle.Interval <= 0 || cycle.First < 0 || cycle.Last >= len(p) || cycle.First >= cycle.Last {
+		return 0
+	}
+	n := cycle.Last - cycle.First + 1
+	shift := int(elapsed/cycle.Interval) % n
+	if cycle.Reverse && shift != 0 {
+		shift = n - shift
+	}
+	return shift
+}
+
+// Returns p with the cycling ranges rotated as far as they have gone
+// after elapsed. p itself is returned if nothing has moved, so the
+// result mustn't be modified.
+func CyclePalette(p color.Palette, cycles []ColourCycle, elapsed time.Duration) color.Palette {
+	ret := p
+	for _, cycle := range cycles {
+		shift := cycleShift(p, cycle, elapsed)
+		if shift == 0 {
+			continue
+		}
+		if &ret[0] == &p[0] {
+			ret = slices.Clone(p)
+		}
+		n := cycle.Last - cycle.First + 1
+		for i := range n {
+			ret[cycle.First+(i+shift)%n] = p[cycle.First+i]
+		}
+	}
+	return ret
+}
+
+// Runs fades and colour cycling on a palette over time
+type PaletteAnimator struct {
+	current      color.Palette // Where the running fade started or the settled palette
+	target       color.Palette // nil when no fade is running
+	fadeStart    time.Time
+	fadeDuration time.Duration
+	cycles       []ColourCycle
+	cycleStart   time.Time
+	now          func() time.Time
+
+	// The last cycled palette, kept until its base changes or a range
+	// moves on so Palette doesn't make a new one every frame
+	cycled      color.Palette
+	cycledBase  color.Palette
+	cycledShift []int
+	shift       []int
+}
+
+func NewPaletteAnimator(p color.Palette) *PaletteAnimator {
+	return &PaletteAnimator{
+		current:    p,
+		cycleStart: time.Now(),
+		now:        time.Now,
+	}
+}
+
+// Starts fading from the palette shown now to target over duration
+func (a *PaletteAnimator) FadeTo(target color.Palette, duration time.Duration) {
+	now := a.now()
+	a.current = a.faded(now)
+	a.target = target
+	a.fadeStart = now
+	a.fadeDuration = duration
+}
+
+// Fades the palette shown now to black
+func (a *PaletteAnimator) FadeOut(duration time.Duration) {
+	a.FadeTo(BlackPalette(a.faded(a.now())), duration)
+}
+
+// Starts from black and fades to target
+func (a *PaletteAnimator) FadeIn(target color.Palette, duration time.Duration) {
+	a.current = BlackPalette(target)
+	a.target = nil
+	a.FadeTo(target, duration)
+}
+
+// Replaces the colour cycling ranges. Cycling starts over.
+func (a *PaletteAnimator) Cycle(cycles ...ColourCycle) {
+	a.cycles = cycles
+	a.cycleStart = a.now()
+	a.cycled = nil
+	a.shift = make([]int, len(cycles))
+	a.cycledShift = make([]int, len(cycles))
+}
+
+// Whether a fade is still running
+func (a *PaletteAnimator) Fading() bool {
+	return a.target != nil && a.now().Sub(a.fadeStart) < a.fadeDuration
+}
+
+// The palette to show now. It mustn't be modified.
+func (a *PaletteAnimator) Palette() color.Palette {
+	now := a.now()
+	base := a.faded(now)
+	if len(a.cycles) == 0 || len(base) == 0 {
+		return base
+	}
+	for i, cycle := range a.cycles {
+		a.shift[i] = cycleShift(base, cycle, now.Sub(a.cycleStart))
+	}
+	if a.cycled == nil || &base[0] != &a.cycledBase[0] || !slices.Equal(a.shift, a.cycledShift) {
+		a.cycled = CyclePalette(base, a.cycles, now.Sub(a.cycleStart))
+		a.cycledBase = base
+		copy(a.cycledShift, a.shift)
+	}
+	return a.cycled
+}
+
+// The faded palette at now. A fade that has finished settles on its
+// target.
+func (a *PaletteAnimator) faded(now time.Time) color.Palette {
+	if a.target == nil {
+		return a.current
+	}
+	elapsed := now.Sub(a.fadeStart)
+	if elapsed >= a.fadeDuration {
+		a.current = a.target
+		a.target = nil
+		return a.current
+	}
+	return LerpPalette(a.current, a.target, float64(elapsed)/float64(a.fadeDuration))
+}
+
+// An ebiten image drawn from colour indices. The pixels are only
+// rewritten when the palette changes.
+type PalettedImage struct {
+	src     *image.Paletted
+	image   *ebiten.Image
+	pixels  []byte
+	palette color.Palette
+}
+
+func NewPalettedImage(src *image.Paletted) *PalettedImage {
+	b := src.Bounds()
+	return &PalettedImage{
+		src:    src,
+		image:  ebiten.NewImage(b.Dx(), b.Dy()),
+		pixels: make([]byte, 4*b.Dx()*b.Dy()),
+	}
+}
+
+// Returns the image drawn with palette
+func (p *PalettedImage) Image(palette color.Palette) *ebiten.Image {
+	if p.palette != nil && slices.Equal(p.palette, palette) {
+		return p.image
+	}
+	p.palette = palette
+	rgba := make([][4]byte, len(palette))
+	for i, c := range palette {
+		r, g, b, a := c.RGBA() // Alpha premultiplied like ebiten wants
+		rgba[i] = [4]byte{byte(r >> 8), byte(g >> 8), byte(b >> 8), byte(a >> 8)}
+	}
+	bounds := p.src.Bounds()
+	i := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := p.src.Pix[p.src.PixOffset(bounds.Min.X, y):]
+		for x := range bounds.Dx() {
+			var c [4]byte
+			if int(row[x]) < len(rgba) {
+				c = rgba[row[x]]
+			}
+			copy(p.pixels[i:i+4], c[:])
+			i += 4
+		}
+	}
+	p.image.WritePixels(p.pixels)
+	return p.image
+}
@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"image/color"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A palette where entry i is grey level i*step
+func greys(n int, step int) color.Palette {
+	ret := make(color.Palette, n)
+	for i := range ret {
+		v := uint8(i * step)
+		ret[i] = color.RGBA{v, v, v, 255}
+	}
+	return ret
+}
+
+func TestLerpPalette(t *testing.T) {
+	a := greys(4, 10)
+	b := greys(4, 50)
+	for _, test := range []struct {
+		t    float64
+		want color.Palette
+	}{
+		{0, a},
+		{1, b},
+		{-1, a}, // Clamped
+		{2, b},
+		{0.5, greys(4, 30)},
+	} {
+		if got := LerpPalette(a, b, test.t); !slices.Equal(got, test.want) {
+			t.Errorf("t = %v: got %v, want %v", test.t, got, test.want)
+		}
+	}
+
+	// The missing entry of the shorter palette is transparent black
+	got := LerpPalette(a[:3], b, 1)
+	if !slices.Equal(got, b) {
+		t.Errorf("got %v, want %v", got, b)
+	}
+	got = LerpPalette(a[:3], b, 0)
+	if got[3] != (color.RGBA{}) {
+		t.Errorf("missing entry became %v", got[3])
+	}
+}
+
+func TestCyclePalette(t *testing.T) {
+	p := greys(6, 1)
+	forward := ColourCycle{First: 1, Last: 4, Interval: time.Second}
+	backward := forward
+	backward.Reverse = true
+	order := func(p color.Palette) []uint8 {
+		ret := make([]uint8, len(p))
+		for i, c := range p {
+			ret[i] = c.(color.RGBA).R
+		}
+		return ret
+	}
+	for _, test := range []struct {
+		cycle   ColourCycle
+		elapsed time.Duration
+		want    []uint8
+	}{
+		{forward, 0, []uint8{0, 1, 2, 3, 4, 5}},
+		{forward, 1500 * time.Millisecond, []uint8{0, 4, 1, 2, 3, 5}},
+		{forward, 3 * time.Second, []uint8{0, 2, 3, 4, 1, 5}},
+		{forward, 4 * time.Second, []uint8{0, 1, 2, 3, 4, 5}}, // Wrapped around
+		{forward, 5 * time.Second, []uint8{0, 4, 1, 2, 3, 5}},
+		{backward, time.Second, []uint8{0, 2, 3, 4, 1, 5}},
+		{backward, 4 * time.Second, []uint8{0, 1, 2, 3, 4, 5}},
+		{ColourCycle{First: 4, Last: 6, Interval: time.Second}, time.Second, []uint8{0, 1, 2, 3, 4, 5}}, // Past the end
+	} {
+		got := CyclePalette(p, []ColourCycle{test.cycle}, test.elapsed)
+		if !slices.Equal(order(got), test.want) {
+			t.Errorf("%+v after %v: got %v, want %v", test.cycle, test.elapsed, order(got), test.want)
+		}
+	}
+	if !slices.Equal(order(p), []uint8{0, 1, 2, 3, 4, 5}) {
+		t.Errorf("palette was modified: %v", order(p))
+	}
+}
+
+// An animator whose clock only moves when the test says so
+func testAnimator(p color.Palette) (*PaletteAnimator, func(time.Duration)) {
+	now := time.Unix(0, 0)
+	a := NewPaletteAnimator(p)
+	a.now = func() time.Time { return now }
+	a.cycleStart = now
+	return a, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestPaletteAnimatorFade(t *testing.T) {
+	start := greys(4, 10)
+	target := greys(4, 50)
+	a, advance := testAnimator(start)
+
+	a.FadeTo(target, time.Second)
+	advance(500 * time.Millisecond)
+	if !a.Fading() || !slices.Equal(a.Palette(), greys(4, 30)) {
+		t.Fatalf("halfway through the fade got %v", a.Palette())
+	}
+	advance(500 * time.Millisecond)
+	if a.Fading() || !slices.Equal(a.Palette(), target) {
+		t.Fatalf("finished fade got %v", a.Palette())
+	}
+	advance(time.Hour)
+	if a.Fading() || !slices.Equal(a.Palette(), target) {
+		t.Fatalf("fade didn't stay on its target: %v", a.Palette())
+	}
+
+	withHole := slices.Clone(target)
+	withHole[0] = color.RGBA{} // Has to stay transparent
+	a.FadeTo(withHole, 0)
+	a.FadeOut(time.Second)
+	advance(2 * time.Second)
+	want := color.Palette{color.RGBA{}, color.RGBA{0, 0, 0, 255}, color.RGBA{0, 0, 0, 255}, color.RGBA{0, 0, 0, 255}}
+	if a.Fading() || !slices.Equal(a.Palette(), want) {
+		t.Fatalf("fade out got %v", a.Palette())
+	}
+
+	a.FadeIn(start, time.Second)
+	if got := a.Palette(); !slices.Equal(got, BlackPalette(start)) {
+		t.Fatalf("fade in started from %v", got)
+	}
+	advance(time.Second)
+	if a.Fading() || !slices.Equal(a.Palette(), start) {
+		t.Fatalf("fade in got %v", a.Palette())
+	}
+}
+
+func TestPaletteAnimatorCycle(t *testing.T) {
+	p := greys(6, 1)
+	a, advance := testAnimator(p)
+	if got := a.Palette(); &got[0] != &p[0] {
+		t.Fatal("settled palette without cycles was copied")
+	}
+
+	a.Cycle(ColourCycle{First: 1, Last: 4, Interval: time.Second})
+	advance(time.Second)
+	first := a.Palette()
+	if first[1] != p[4] {
+		t.Fatalf("range didn't rotate: %v", first)
+	}
+	advance(500 * time.Millisecond)
+	if got := a.Palette(); &got[0] != &first[0] {
+		t.Fatal("palette was made again before the range moved on")
+	}
+	advance(500 * time.Millisecond)
+	if got := a.Palette(); got[1] != p[3] {
+		t.Fatalf("range didn't rotate again: %v", got)
+	}
+}
@@ -1,13 +1,15 @@
 package formats
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"log/slog"
 
-	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
 	"golang.org/x/image/draw"
 )
 
@@ -18,167 +20,196 @@ type CMPHeader struct {
 	paletteSize      uint16
 }
 
-func parseCmpHeader(data []byte) (CMPHeader, string) {
+func parseCmpHeader(data []byte) CMPHeader {
 	fileSize := binary.LittleEndian.Uint16(data[0:2])
 	compressionType := binary.LittleEndian.Uint16(data[2:4])
 	uncompressedSize := binary.LittleEndian.Uint32(data[4:8])
 	paletteSize := binary.LittleEndian.Uint16(data[8:10])
-	checksum := fmt.Sprintf("%x", md5.Sum(data))
 	return CMPHeader{
 		fileSize:         fileSize,
 		compressionType:  compressionType,
 		uncompressedSize: uncompressedSize,
 		paletteSize:      paletteSize,
-	}, checksum
+	}
 }
 
 func (h CMPHeader) String() string {
-	return fmt.Sprintf("File size : %8d | Compression type : %d | Uncompressed size : %d | Palette size : %d",
-		h.fileSize, h.compressionType, h.uncompressedSize, h.paletteSize)
+	return fmt.Sprintf("File size : %8d | Compression type : %d (%s) | Uncompressed size : %d | Palette size : %d",
+		h.fileSize, h.compressionType, compressionName(h.compressionType), h.uncompressedSize, h.paletteSize)
 }
 
-func parseCmpBody(header CMPHeader, input []byte, palette color.Palette) ([]byte, error) {
+// Size of the palette embedded between the header and the body
+func (h CMPHeader) PaletteSize() int {
+	return int(h.paletteSize)
+}
+
+var (
+	ErrUnsupportedCompression = errors.New("unsupported compression type")
+	ErrCmpTruncated           = errors.New("image data ends before the image does")
+)
+
+// Largest uncompressed size accepted in a CMP/CPS header. The images in
+// the games are at most 64000 bytes.
+const MaxCmpSize = 1 << 20
+
+// Returned for a CMP/CPS header whose uncompressed size is more than
+// MaxCmpSize or more than the body could expand to
+type CmpSizeError struct {
+	Size  uint32 // Uncompressed size in the header
+	Limit int
+}
+
+func (e *CmpSizeError) Error() string {
+	return fmt.Sprintf("implausible uncompressed size of %d bytes, at most %d possible", e.Size, e.Limit)
+}
+
+// Most bytes a body of the given compression type and length can
+// decompress to. Fills of up to 65535 bytes take 4 bytes in both RLE and
+// LCW, and nothing expands further than that. Types that can't be
+// decoded aren't limited here since they're rejected without allocating.
+func maxCmpExpansion(compressionType uint16, bodyLen int) int {
+	switch compressionType {
+	case CmpUncompressed:
+		return bodyLen
+	case CmpRLE, CmpLCW:
+		return (bodyLen + 3) / 4 * 65535
+	}
+	return MaxCmpSize
+}
+
+func compressionName(compressionType uint16) string {
+	switch compressionType {
+	case CmpUncompressed:
+		return "uncompressed"
+	case CmpLZW12:
+		return "LZW-12"
+	case CmpLZW14:
+		return "LZW-14"
+	case CmpRLE:
+		return "RLE"
+	case CmpLCW:
+		return "LCW"
+	}
+	return "unknown"
+}
+
+// Decompresses body according to the compression type in header
+func decompressCmpBody(header CMPHeader, body []byte) ([]byte, error) {
+	switch header.compressionType {
+	case CmpUncompressed:
+		if len(body) < int(header.uncompressedSize) {
+			return nil, fmt.Errorf("%w: %d of %d uncompressed bytes", ErrCmpTruncated, len(body), header.uncompressedSize)
+		}
+		return body[:header.uncompressedSize], nil
+	case CmpRLE:
+		return parseRLEBody(header, body)
+	case CmpLCW:
+		return parseCmpBody(header, body, nil)
+	case CmpLZW12, CmpLZW14:
+		// There are no type 1 or 2 files at hand to check a decoder
+		// against, so these aren't guessed at
+		return nil, fmt.Errorf("%w: %d (%s)", ErrUnsupportedCompression, header.compressionType, compressionName(header.compressionType))
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, header.compressionType)
+}
+
+var (
+	ErrRLETruncated = errors.New("RLE code runs past the end of the input")
+	ErrRLEOverflow  = errors.New("RLE code writes past the end of the output")
+)
+
+// A problem with an RLE stream
+type RLEError struct {
+	Offset int    // Position of the code in the compressed stream
+	Output int    // Output position when the code was reached
+	Code   string // fill, run or copy. Empty if the stream ended before the image did
+	Count  int
+	Err    error
+}
+
+func (e *RLEError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%v: at offset %d (output position %d)", e.Err, e.Offset, e.Output)
+	}
+	return fmt.Sprintf("%v: %s of %d at offset %d (output position %d)", e.Err, e.Code, e.Count, e.Offset, e.Output)
+}
+
+func (e *RLEError) Unwrap() error {
+	return e.Err
+}
+
+// Decodes the RLE scheme (compression type 3) used by Kyrandia. A 0 code
+// is followed by a big endian count and a value to repeat, a negative
+// code repeats the next byte -code times and a positive code copies that
+// many literal bytes.
+func parseRLEBody(header CMPHeader, input []byte) ([]byte, error) {
 	output := make([]byte, header.uncompressedSize)
 	inputPos := 0
 	outputPos := 0
-	var relativeMode bool
-	firstBytePattern := utils.BytesToBinary([]byte{input[0]})
-
-	commandCount := 0
-	CmpLogger.Debug("First byte", "pattern", firstBytePattern)
-	if input[0] == 0x0 {
-		CmpLogger.Debug("Relative mode")
-		relativeMode = true
+	for outputPos < len(output) {
+		if inputPos >= len(input) {
+			return nil, &RLEError{Offset: inputPos, Output: outputPos, Err: ErrRLETruncated}
+		}
+		start := inputPos
+		code := int8(input[inputPos])
 		inputPos += 1
-	} else {
-		CmpLogger.Debug("Absolute mode")
-		relativeMode = false
-	}
-
-	for inputPos < len(input) {
-		commandCount += 1
-		inDone := fmt.Sprintf("%04d/%04d (%.2f%%)", inputPos, len(input), (float64(inputPos)/float64(len(input)))*100)
-		opDone := fmt.Sprintf("%06d/%06d (%.2f%%)", outputPos, len(output), (float64(outputPos)/float64(len(output)))*100)
-		current := input[inputPos]
-		if current == 0x80 {
-			CmpLogger.Debug("End of stream")
-			break
-		} else if (current & 0x80) == 0 {
-			begin := inputPos
-			// Copy count bytes in output buffer from outputPos - pos to  outputPos
-			pattern := utils.BytesToBinary([]byte{input[inputPos], input[inputPos+1]})
-			count := ((current & 0x70) >> 4) + 3
-			tpos0 := current & 0x0f                  // Lower nibble of the current byte
-			tpos1 := int(tpos0) << 8                 // Moves it a byte to the left so now, we have 12 bits with the above 4 as the most significant bits
-			inputPos += 1                            // Get the next byte
-			pos := int(tpos1 + int(input[inputPos])) // Adds the next byte. So there's 12 bits now
-			source := outputPos - pos
-			CmpLogger.Debug("C2:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "from", source)
-			if source < 0 || source >= len(output) {
-				CmpLogger.Error("C2 invalid source", "source", source, "outputPos", outputPos, "pos", pos)
-				return nil, fmt.Errorf("invalid source position")
+		switch {
+		case code == 0:
+			if inputPos+3 > len(input) {
+				return nil, &RLEError{Offset: start, Output: outputPos, Code: "fill", Err: ErrRLETruncated}
 			}
-			for range count {
-				output[outputPos] = output[source]
-				outputPos += 1
-				source += 1
+			count := int(binary.BigEndian.Uint16(input[inputPos : inputPos+2]))
+			value := input[inputPos+2]
+			inputPos += 3
+			if outputPos+count > len(output) {
+				return nil, &RLEError{Offset: start, Output: outputPos, Code: "fill", Count: count, Err: ErrRLEOverflow}
 			}
-			inputPos += 1 // Go to the next command
-			if inputPos != begin+2 {
-				panic("C2 Increment wrong")
-			}
-		} else if current == 0xfe {
-			begin := inputPos
-			pattern := utils.BytesToBinary([]byte{input[inputPos], input[inputPos+1], input[inputPos+2], input[inputPos+3]})
-			inputPos += 1                                                     // Leave command and Go to count byte 1
-			count := binary.LittleEndian.Uint16(input[inputPos : inputPos+2]) // Read Count byte 1 and 2
-			inputPos += 2                                                     // Go to value
-			value := input[inputPos]
-			CmpLogger.Debug("C4:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "value", value)
 			for range count {
 				output[outputPos] = value
 				outputPos += 1
 			}
-			inputPos += 1 // Go to next command
-			if inputPos != begin+4 {
-				panic("C4 Increment wrong")
+		case code < 0:
+			count := -int(code)
+			if inputPos >= len(input) {
+				return nil, &RLEError{Offset: start, Output: outputPos, Code: "run", Count: count, Err: ErrRLETruncated}
 			}
-
-		} else if current == 0xff {
-			begin := inputPos
-			pattern := utils.BytesToBinary(input[inputPos : inputPos+5])
-			count := int(binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3]))
-			pos := int(binary.LittleEndian.Uint16(input[inputPos+3 : inputPos+5]))
-			var target int
-			if relativeMode {
-				target = outputPos - pos
-			} else {
-				target = pos
+			if outputPos+count > len(output) {
+				return nil, &RLEError{Offset: start, Output: outputPos, Code: "run", Count: count, Err: ErrRLEOverflow}
 			}
-			CmpLogger.Debug("C5:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "to", target)
-			for range count {
-				output[outputPos] = output[target]
-				outputPos += 1
-				target += 1
-			}
-			inputPos += 5
-
-			if inputPos != begin+5 {
-				panic("C5 Increment wrong")
-			}
-		} else if (current & 0xc0) == 0x80 {
-			begin := inputPos
-			pattern := utils.BytesToBinary([]byte{current})
-			count := current & 0x3f
-			CmpLogger.Debug("C1:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern)
-			if count == 0 {
-				CmpLogger.Debug("Count 0. End of stream")
-			}
-			inputPos += 1 // Go to data
 			for range count {
 				output[outputPos] = input[inputPos]
-				inputPos += 1
 				outputPos += 1
 			}
-			if inputPos != begin+int(count)+1 {
-				panic("C1 Increment wrong")
-			}
-		} else if (current & 0xc0) == 0xc0 {
-			begin := inputPos
-			pattern := utils.BytesToBinary([]byte{
-				input[inputPos],
-				input[inputPos+1],
-				input[inputPos+2],
-			})
-			count := (current & 0x3f) + 3
-			var target int
-			pos := int(binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3]))
-			if relativeMode {
-				target = outputPos - pos
-			} else {
-				target = pos
-			}
-			CmpLogger.Debug("C3:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "to", target)
-			if target < 0 || target >= len(output) {
-				CmpLogger.Error("C3 invalid target", "target", target, "outputPos", outputPos, "pos", pos)
-				return nil, fmt.Errorf("invalid target position")
-			}
-			for range count {
-				output[outputPos] = output[target]
-				outputPos += 1
-				target += 1
+			inputPos += 1
+		default:
+			count := int(code)
+			if inputPos+count > len(input) {
+				return nil, &RLEError{Offset: start, Output: outputPos, Code: "copy", Count: count, Err: ErrRLETruncated}
 			}
-			inputPos += 3 //Go to next command
-			if inputPos != begin+3 {
-				panic("C3 Increment wrong")
+			if outputPos+count > len(output) {
+				return nil, &RLEError{Offset: start, Output: outputPos, Code: "copy", Count: count, Err: ErrRLEOverflow}
 			}
-		} else {
-			CmpLogger.Error("Corrupt file. This shouldn't happen")
-			break
+			outputPos += copy(output[outputPos:], input[inputPos:inputPos+count])
+			inputPos += count
 		}
-
 	}
+	return output, nil
+}
 
+func parseCmpBody(header CMPHeader, input []byte, palette color.Palette) ([]byte, error) {
+	output := make([]byte, header.uncompressedSize)
+	var trace *slog.Logger
+	if traceLCW {
+		trace = CmpLogger
+	}
+	n, err := decodeLCW(input, output, trace)
+	if err != nil {
+		CmpLogger.Error("Corrupt LCW stream", "error", err)
+		return nil, err
+	}
+	if n < len(output) {
+		return nil, fmt.Errorf("%w: LCW stream stops after %d of %d bytes", ErrCmpTruncated, n, len(output))
+	}
 	return output, nil
 }
 
@@ -205,21 +236,95 @@ func CMPToImage(data []byte, palette color.Palette, origWidth int, origHeight in
 	return img
 }
 
+// Transparent index for CMPToPaletted that keeps every colour opaque
+const NoTransparency = -1
+
+// Converts a CMP data stream in data to an image.Paletted that keeps the
+// colour indices. The palette is copied and padded to 256 colours, and
+// the entry at transparent is made fully transparent unless it's
+// NoTransparency.
+func CMPToPaletted(data []byte, palette color.Palette, width int, height int, transparent int) *image.Paletted {
+	imagePalette := make(color.Palette, 256)
+	for i := range imagePalette {
+		if i < len(palette) {
+			imagePalette[i] = palette[i]
+		} else {
+			imagePalette[i] = color.RGBA{0, 0, 0, 255}
+		}
+	}
+	if transparent >= 0 && transparent < len(imagePalette) {
+		imagePalette[transparent] = color.RGBA{0, 0, 0, 0}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, width, height), imagePalette)
+	copy(img.Pix, data)
+	return img
+}
+
 func ResizeImage(src image.Image, newWidth, newHeight int) *image.RGBA {
 	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
 	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
 	return dst
 }
 
+// A decoded CMP/CPS file
+type CpsImage struct {
+	Header  CMPHeader
+	Pixels  []byte
+	Palette color.Palette // Palette embedded in the file. nil if there's none
+}
+
+// Checks the sizes in a header before anything is allocated for them
+func checkCmpHeader(header CMPHeader) error {
+	if header.paletteSize%3 != 0 || header.paletteSize > 768 {
+		return fmt.Errorf("invalid embedded palette size %d", header.paletteSize)
+	}
+	if header.uncompressedSize > MaxCmpSize {
+		return &CmpSizeError{Size: header.uncompressedSize, Limit: MaxCmpSize}
+	}
+	return nil
+}
+
+// Decodes a complete CMP/CPS file. An embedded palette sits between the
+// header and the compressed body. Sizes in the header are checked
+// against MaxCmpSize and the length of the body before the image is
+// allocated.
+func DecodeCps(data []byte) (*CpsImage, error) {
+	if len(data) < 10 {
+		return nil, fmt.Errorf("file too short for a CMP header: %d bytes", len(data))
+	}
+	header := parseCmpHeader(data)
+	if CmpLogger.Enabled(context.Background(), slog.LevelDebug) {
+		CmpLogger.Debug("Header obtained", "header", header.String(), "checksum", fmt.Sprintf("%x", md5.Sum(data)))
+	}
+	if err := checkCmpHeader(header); err != nil {
+		return nil, err
+	}
+	bodyStart := 10 + int(header.paletteSize)
+	if bodyStart > len(data) {
+		return nil, fmt.Errorf("embedded palette of %d bytes runs past the end of the file", header.paletteSize)
+	}
+	if limit := maxCmpExpansion(header.compressionType, len(data)-bodyStart); int(header.uncompressedSize) > limit {
+		return nil, &CmpSizeError{Size: header.uncompressedSize, Limit: limit}
+	}
+	ret := &CpsImage{Header: header}
+	if header.paletteSize != 0 {
+		ret.Palette = DecodePalette(data[10:bodyStart])
+	}
+	pixels, err := decompressCmpBody(header, data[bodyStart:])
+	if err != nil {
+		return nil, err
+	}
+	ret.Pixels = pixels
+	return ret, nil
+}
+
 func DecodeCmp(filename string, fileContents []byte, palette color.Palette) []byte {
 	CmpLogger.Info("Decompressing CMP file", "name", filename)
-	header, checksum := parseCmpHeader(fileContents)
-	CmpLogger.Debug("Header obtained", "header", header.String(), "checksum", checksum)
-	decompressedData, err := parseCmpBody(header, fileContents[10:], palette) // TODO : Probably need to check for compression type etc. here
+	decoded, err := DecodeCps(fileContents)
 	if err != nil {
 		CmpLogger.Error("Aborted ", "error", err)
 		return []byte{}
 	} else {
-		return decompressedData
+		return decoded.Pixels
 	}
 }
@@ -0,0 +1,113 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// Builds a CMP/CPS file around body with the header filled in
+func cmpFile(compressionType uint16, size uint32, palette []byte, body []byte) []byte {
+	data := make([]byte, 10, 10+len(palette)+len(body))
+	binary.LittleEndian.PutUint16(data[0:2], uint16(8+len(palette)+len(body)))
+	binary.LittleEndian.PutUint16(data[2:4], compressionType)
+	binary.LittleEndian.PutUint32(data[4:8], size)
+	binary.LittleEndian.PutUint16(data[8:10], uint16(len(palette)))
+	data = append(data, palette...)
+	return append(data, body...)
+}
+
+func TestRLE(t *testing.T) {
+	header := CMPHeader{compressionType: CmpRLE, uncompressedSize: 12}
+	// Fill of 3, run of 2, copy of 3 and a fill of 4
+	stream := []byte{0, 0, 3, 9, 0xfe, 7, 3, 1, 2, 3, 0, 0, 4, 5}
+	output, err := decompressCmpBody(header, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, []byte{9, 9, 9, 7, 7, 1, 2, 3, 5, 5, 5, 5}) {
+		t.Fatalf("decoded %v", output)
+	}
+
+	for _, test := range []struct {
+		name   string
+		stream []byte
+		err    error
+		offset int
+		code   string
+	}{
+		{"short stream", stream[:10], ErrRLETruncated, 10, ""},
+		{"fill cut short", []byte{0xfe, 7, 0, 0}, ErrRLETruncated, 2, "fill"},
+		{"run cut short", []byte{0xfe}, ErrRLETruncated, 0, "run"},
+		{"copy cut short", []byte{3, 1, 2}, ErrRLETruncated, 0, "copy"},
+		{"fill too long", []byte{0xfe, 7, 0, 0, 30, 9}, ErrRLEOverflow, 2, "fill"},
+		{"run too long", []byte{0x80, 7}, ErrRLEOverflow, 0, "run"},
+		{"copy too long", append([]byte{13}, stream[:13]...), ErrRLEOverflow, 0, "copy"},
+	} {
+		_, err := decompressCmpBody(header, test.stream)
+		var rleErr *RLEError
+		if !errors.As(err, &rleErr) || !errors.Is(err, test.err) || rleErr.Offset != test.offset || rleErr.Code != test.code {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	for _, compressionType := range []uint16{CmpLZW12, CmpLZW14, 5} {
+		header := CMPHeader{compressionType: compressionType, uncompressedSize: 10}
+		if _, err := decompressCmpBody(header, make([]byte, 10)); !errors.Is(err, ErrUnsupportedCompression) {
+			t.Errorf("compression type %d: got %v", compressionType, err)
+		}
+	}
+}
+
+// Headers claiming more than MaxCmpSize or more than the body can hold
+// are refused before anything is allocated for them
+func TestDecodeCpsSizes(t *testing.T) {
+	body := CompressLCW(bytes.Repeat([]byte{1, 2, 3}, 1000), false)
+	for _, size := range []uint32{1 << 30, 0xffffffff, MaxCmpSize + 1, uint32(maxCmpExpansion(CmpLCW, len(body)) + 1)} {
+		var sizeErr *CmpSizeError
+		if _, err := DecodeCps(cmpFile(CmpLCW, size, nil, body)); !errors.As(err, &sizeErr) || sizeErr.Size != size {
+			t.Errorf("size %d: got %v", size, err)
+		}
+		if _, err := DecodeCps(cmpFile(CmpUncompressed, size, nil, body)); !errors.As(err, &sizeErr) {
+			t.Errorf("uncompressed size %d: got %v", size, err)
+		}
+	}
+	if _, err := DecodeCps(cmpFile(CmpLCW, 3001, nil, body)); !errors.Is(err, ErrCmpTruncated) {
+		t.Errorf("LCW stream ending early: got %v", err)
+	}
+	if _, err := DecodeCps(cmpFile(CmpLCW, 3000, nil, body)); err != nil {
+		t.Errorf("LCW stream: %v", err)
+	}
+}
+
+// Whole files, valid or not, mustn't panic, and an image that decodes
+// has to be the size its header says
+func FuzzDecodeCps(f *testing.F) {
+	pixels := make([]byte, 320*200)
+	for i := range pixels {
+		pixels[i] = byte((i%320)/7 + (i/320)/5)
+	}
+	for _, relative := range []bool{false, true} {
+		data, err := EncodeCmp(pixels, relative)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	palette := bytes.Repeat([]byte{63, 0, 32}, 256)
+	f.Add(cmpFile(CmpLCW, 3000, palette, CompressLCW(bytes.Repeat([]byte{1, 2, 3}, 1000), true)))
+	f.Add(cmpFile(CmpRLE, 12, nil, []byte{0, 0, 3, 9, 0xfe, 7, 3, 1, 2, 3, 0, 0, 4, 5}))
+	f.Add(cmpFile(CmpUncompressed, 16, palette[:48], bytes.Repeat([]byte{4}, 16)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := DecodeCps(data)
+		if err != nil {
+			return
+		}
+		if len(decoded.Pixels) != int(decoded.Header.uncompressedSize) || len(decoded.Pixels) > MaxCmpSize {
+			t.Fatalf("decoded %d bytes for a header of %s", len(decoded.Pixels), decoded.Header)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package formats
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"sync"
+)
+
+// Lets image.Decode and image.DecodeConfig read CMP/CPS files. The
+// header has no dimensions, so images are taken to be 320 pixels wide,
+// which is what every full screen image in the games is.
+//
+// The header has no magic number either, so files are recognised by
+// their compression type alone, which any format registered after this
+// one could also match. Code that knows it has a CMP/CPS file, like
+// Assets.GetSprite, should call DecodeCps instead.
+const cpsWidth = 320
+
+var (
+	cpsPaletteMu      sync.RWMutex
+	cpsDefaultPalette color.Palette
+	greyscalePalette  = func() color.Palette {
+		ret := make(color.Palette, 256)
+		for i := range ret {
+			ret[i] = color.Gray{uint8(i)}
+		}
+		return ret
+	}()
+)
+
+func init() {
+	image.RegisterFormat("cps", "??\x04\x00", decodeCpsImage, decodeCpsConfig)
+	image.RegisterFormat("cps", "??\x03\x00", decodeCpsImage, decodeCpsConfig)
+	// Uncompressed files are only recognised at full screen size since
+	// a 0 compression type on its own matches too much
+	image.RegisterFormat("cps", "??\x00\x00\x00\xfa\x00\x00", decodeCpsImage, decodeCpsConfig)
+}
+
+// Sets the palette image.Decode uses for CPS files without an embedded
+// palette. nil goes back to a greyscale ramp.
+func SetDefaultCpsPalette(palette color.Palette) {
+	cpsPaletteMu.Lock()
+	defer cpsPaletteMu.Unlock()
+	cpsDefaultPalette = palette
+}
+
+// Returns the palette set with SetDefaultCpsPalette or a greyscale ramp.
+// The palette is shared and mustn't be modified.
+func DefaultCpsPalette() color.Palette {
+	cpsPaletteMu.RLock()
+	defer cpsPaletteMu.RUnlock()
+	if cpsDefaultPalette != nil {
+		return cpsDefaultPalette
+	}
+	return greyscalePalette
+}
+
+func cpsBounds(pixels int) image.Rectangle {
+	return image.Rect(0, 0, cpsWidth, (pixels+cpsWidth-1)/cpsWidth)
+}
+
+func decodeCpsConfig(r io.Reader) (image.Config, error) {
+	var header [10]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return image.Config{}, fmt.Errorf("reading CPS header: %w", err)
+	}
+	cmpHeader := parseCmpHeader(header[:])
+	if err := checkCmpHeader(cmpHeader); err != nil {
+		return image.Config{}, err
+	}
+	var palette color.Palette
+	if paletteSize := cmpHeader.PaletteSize(); paletteSize != 0 {
+		paletteData := make([]byte, paletteSize)
+		if _, err := io.ReadFull(r, paletteData); err != nil {
+			return image.Config{}, fmt.Errorf("reading CPS palette: %w", err)
+		}
+		palette = DecodePalette(paletteData)
+	} else {
+		palette = DefaultCpsPalette()
+	}
+	bounds := cpsBounds(int(cmpHeader.uncompressedSize))
+	return image.Config{
+		ColorModel: palette,
+		Width:      bounds.Dx(),
+		Height:     bounds.Dy(),
+	}, nil
+}
+
+// Decodes to an opaque *image.Paletted using the embedded palette if
+// there's one and the default palette otherwise
+func decodeCpsImage(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading CPS file: %w", err)
+	}
+	decoded, err := DecodeCps(data)
+	if err != nil {
+		return nil, err
+	}
+	palette := decoded.Palette
+	if palette == nil {
+		palette = DefaultCpsPalette()
+	}
+	bounds := cpsBounds(len(decoded.Pixels))
+	return CMPToPaletted(decoded.Pixels, palette, bounds.Dx(), bounds.Dy(), NoTransparency), nil
+}
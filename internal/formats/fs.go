@@ -0,0 +1,181 @@
+package formats
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A read only io/fs view of Assets. Asset names are used as paths so
+// a prefixed asset like ENHANCED/INTRO2.MP3 shows up as INTRO2.MP3
+// inside the ENHANCED directory. Names are listed in upper case but
+// can be opened in any case.
+type assetFS struct {
+	assets *Assets
+}
+
+// Returns the assets as a file system that can be used with
+// fs.WalkDir, fs.Glob, http.FS, template.ParseFS etc. Files are only
+// read when they're opened.
+func (a *Assets) FS() fs.FS {
+	return assetFS{assets: a}
+}
+
+type assetFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i assetFileInfo) Name() string       { return i.name }
+func (i assetFileInfo) Size() int64        { return i.size }
+func (i assetFileInfo) ModTime() time.Time { return time.Time{} }
+func (i assetFileInfo) IsDir() bool        { return i.dir }
+func (i assetFileInfo) Sys() any           { return nil }
+func (i assetFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type assetFile struct {
+	*bytes.Reader
+	info assetFileInfo
+}
+
+func (f *assetFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *assetFile) Close() error               { return nil }
+
+type assetDir struct {
+	info    assetFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *assetDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *assetDir) Close() error               { return nil }
+func (d *assetDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *assetDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// Lists the files and directories directly under dir. The second
+// return value is false if there's no such directory.
+func (f assetFS) dirEntries(dir string) ([]fs.DirEntry, bool) {
+	prefix := ""
+	if dir != "." {
+		prefix = NormaliseName(dir) + "/"
+	}
+	seen := make(map[string]bool)
+	ret := []fs.DirEntry{}
+	found := dir == "."
+	for _, name := range f.assets.names() {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		found = true
+		child, _, isDir := strings.Cut(rest, "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		info := assetFileInfo{name: child, dir: isDir}
+		if !isDir {
+			info.size, _ = f.assets.size(name)
+		}
+		ret = append(ret, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+	return ret, found
+}
+
+// Validates an fs path. Backslashes are accepted by Assets but io/fs
+// doesn't allow them to be treated as separators so such names are
+// reported as missing here.
+func checkPath(op string, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if strings.Contains(name, "\\") {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (f assetFS) Open(name string) (fs.File, error) {
+	if err := checkPath("open", name); err != nil {
+		return nil, err
+	}
+	if size, exists := f.assets.size(name); exists {
+		data, ok := f.assets.lookup(name)
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return &assetFile{
+			Reader: bytes.NewReader(data),
+			info:   assetFileInfo{name: path.Base(name), size: size},
+		}, nil
+	}
+	entries, exists := f.dirEntries(name)
+	if !exists {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &assetDir{
+		info:    assetFileInfo{name: path.Base(name), dir: true},
+		entries: entries,
+	}, nil
+}
+
+func (f assetFS) ReadFile(name string) ([]byte, error) {
+	if err := checkPath("readfile", name); err != nil {
+		return nil, err
+	}
+	data, exists := f.assets.lookup(name)
+	if !exists {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrNotExist}
+	}
+	return bytes.Clone(data), nil
+}
+
+func (f assetFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkPath("readdir", name); err != nil {
+		return nil, err
+	}
+	entries, exists := f.dirEntries(name)
+	if !exists {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries, nil
+}
+
+func (f assetFS) Stat(name string) (fs.FileInfo, error) {
+	if err := checkPath("stat", name); err != nil {
+		return nil, err
+	}
+	if size, exists := f.assets.size(name); exists {
+		return assetFileInfo{name: path.Base(name), size: size}, nil
+	}
+	if _, exists := f.dirEntries(name); !exists {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return assetFileInfo{name: path.Base(name), dir: true}, nil
+}
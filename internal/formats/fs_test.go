@@ -0,0 +1,101 @@
+package formats
+
+import (
+	"archive/zip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func writeFile(t *testing.T, name string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Writes a zip file with an entry for each name in files
+func writeZip(t *testing.T, name string, files map[string]string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for entry, data := range files {
+		fw, err := w.Create(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Assets from a PAK file, a sideloaded directory with subdirectories and
+// a zip file, in that order
+func testAssets(t *testing.T) *Assets {
+	dir := t.TempDir()
+
+	archive := NewPakArchive()
+	archive.Set("WESTWOOD.CMP", []byte("westwood"))
+	archive.Set("INTRO.PAL", []byte("palette"))
+	archive.Set("EMPTY", nil)
+	if err := archive.WritePakFile(filepath.Join(dir, "EOBDATA.PAK")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(dir, "enhanced", "intro.pal"), []byte("better palette"))
+	writeFile(t, filepath.Join(dir, "enhanced", "music", "intro2.mp3"), []byte("music"))
+	writeFile(t, filepath.Join(dir, "enhanced", "music", "extra", "credits.mp3"), []byte("more music"))
+
+	writeZip(t, filepath.Join(dir, "pack.zip"), map[string]string{
+		"westwood.cmp":     "replacement",
+		"sounds/door.wav":  "creak",
+		"sounds/empty.wav": "",
+	})
+
+	a := NewAssets()
+	t.Cleanup(func() { a.Close() })
+	if err := a.IndexPakFile(filepath.Join(dir, "EOBDATA.PAK"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadExtraAssets(filepath.Join(dir, "enhanced"), "ENHANCED"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadExtraAssets(filepath.Join(dir, "pack.zip"), "PACK"); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAssetsFS(t *testing.T) {
+	a := testAssets(t)
+	err := fstest.TestFS(a.FS(),
+		"EMPTY",
+		"INTRO.PAL",
+		"WESTWOOD.CMP",
+		"ENHANCED/INTRO.PAL",
+		"ENHANCED/MUSIC/INTRO2.MP3",
+		"ENHANCED/MUSIC/EXTRA/CREDITS.MP3",
+		"PACK/WESTWOOD.CMP",
+		"PACK/SOUNDS/DOOR.WAV",
+		"PACK/SOUNDS/EMPTY.WAV",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fs.ReadFile(a.FS(), "enhanced/Music/Extra/credits.mp3")
+	if err != nil || string(data) != "more music" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
@@ -0,0 +1,53 @@
+package formats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PAK files that make up the EOB1 game data
+var EOBDataFiles = []string{"EOBDATA1.PAK", "EOBDATA2.PAK", "EOBDATA3.PAK", "EOBDATA4.PAK", "EOBDATA5.PAK", "EOBDATA6.PAK"}
+
+// Returned when a game data directory doesn't have all of
+// EOBDataFiles. Missing lists the ones that aren't there.
+type GameDataError struct {
+	Dir     string
+	Missing []string
+}
+
+func (e *GameDataError) Error() string {
+	return fmt.Sprintf("unusable game data in %s: missing %s", e.Dir, strings.Join(e.Missing, ", "))
+}
+
+// Finds the PAK files in dir without reading them and returns their
+// paths by name. File names are matched ignoring case. A
+// *GameDataError is returned if any are missing.
+func FindGameData(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read game data directory: %w", err)
+	}
+	onDisk := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			onDisk[strings.ToUpper(entry.Name())] = filepath.Join(dir, entry.Name())
+		}
+	}
+
+	ret := make(map[string]string)
+	missing := []string{}
+	for _, pakFile := range EOBDataFiles {
+		name, exists := onDisk[pakFile]
+		if !exists {
+			missing = append(missing, pakFile)
+			continue
+		}
+		ret[pakFile] = name
+	}
+	if len(missing) != 0 {
+		return nil, &GameDataError{Dir: dir, Missing: missing}
+	}
+	return ret, nil
+}
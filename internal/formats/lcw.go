@@ -0,0 +1,410 @@
+package formats
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+
+	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
+)
+
+const (
+	lcwMaxLiteral   = 63    // C1 : 10cccccc
+	lcwMaxShortLen  = 10    // C2 : 0cccpppp pppppppp
+	lcwMaxShortDist = 4095  //
+	lcwMaxMediumLen = 64    // C3 : 11cccccc pppppppp pppppppp
+	lcwMaxLongLen   = 65535 // C5 : 11111111 cccccccc cccccccc pppppppp pppppppp
+	lcwMaxPos       = 65535 //
+	lcwMinFill      = 64    // Shorter runs are cheaper as copies
+	lcwChainDepth   = 64    // Candidates tried per position while looking for matches
+	lcwHashBits     = 16
+)
+
+// Compression types in the CMP/CPS header
+const (
+	CmpUncompressed = 0
+	CmpLZW12        = 1
+	CmpLZW14        = 2
+	CmpRLE          = 3
+	CmpLCW          = 4
+)
+
+// Greedy LCW (Format80) encoder. Matches are found through hash chains
+// of 3 byte sequences.
+type lcwEncoder struct {
+	input    []byte
+	output   []byte
+	relative bool
+	literals int // Start of the pending literals
+	head     []int32
+	prev     []int32
+}
+
+func lcwHash(b []byte) uint32 {
+	return (uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])) * 2654435761 >> (32 - lcwHashBits)
+}
+
+// Adds position i to the hash chains
+func (e *lcwEncoder) insert(i int) {
+	if i+3 > len(e.input) {
+		return
+	}
+	h := lcwHash(e.input[i:])
+	e.prev[i] = e.head[h]
+	e.head[h] = int32(i)
+}
+
+// Whether a copy from src at position i can use the medium and long
+// forms, which address the output with 16 bits
+func (e *lcwEncoder) addressable(src int, i int) bool {
+	if e.relative {
+		return i-src <= lcwMaxPos
+	}
+	return src <= lcwMaxPos
+}
+
+// Finds the longest earlier copy of the bytes at i. Copies can overlap
+// the current position since the decoder copies a byte at a time.
+func (e *lcwEncoder) longestMatch(i int) (int, int) {
+	if i+3 > len(e.input) {
+		return 0, 0
+	}
+	bestLen, bestSrc := 0, 0
+	for src, depth := int(e.head[lcwHash(e.input[i:])]), 0; src >= 0 && depth < lcwChainDepth; src, depth = int(e.prev[src]), depth+1 {
+		limit := min(len(e.input)-i, lcwMaxLongLen)
+		if !e.addressable(src, i) {
+			if i-src > lcwMaxShortDist {
+				continue
+			}
+			limit = min(limit, lcwMaxShortLen)
+		}
+		n := 0
+		for n < limit && e.input[src+n] == e.input[i+n] {
+			n++
+		}
+		// Chains run from the nearest candidate, which wins ties
+		// since it's the one most likely to fit a short copy
+		if n > bestLen {
+			bestLen, bestSrc = n, src
+		}
+		if n == limit {
+			break
+		}
+	}
+	return bestLen, bestSrc
+}
+
+// Length of the run of identical bytes at i
+func (e *lcwEncoder) runLength(i int) int {
+	n := 1
+	for i+n < len(e.input) && n < lcwMaxLongLen && e.input[i+n] == e.input[i] {
+		n++
+	}
+	return n
+}
+
+// Writes out literals pending up to position end
+func (e *lcwEncoder) flushLiterals(end int) {
+	for e.literals < end {
+		n := min(end-e.literals, lcwMaxLiteral)
+		e.output = append(e.output, 0x80|byte(n))
+		e.output = append(e.output, e.input[e.literals:e.literals+n]...)
+		e.literals += n
+	}
+}
+
+// Encoded size of a copy of n bytes from src at position i
+func (e *lcwEncoder) copyCost(n int, src int, i int) int {
+	switch {
+	case n <= lcwMaxShortLen && i-src <= lcwMaxShortDist:
+		return 2
+	case n <= lcwMaxMediumLen:
+		return 3
+	}
+	return 5
+}
+
+// Writes a copy of n bytes from src at position i
+func (e *lcwEncoder) emitCopy(n int, src int, i int) {
+	dist := i - src
+	pos := src
+	if e.relative {
+		pos = dist
+	}
+	switch e.copyCost(n, src, i) {
+	case 2:
+		e.output = append(e.output, byte((n-3)<<4)|byte(dist>>8), byte(dist))
+	case 3:
+		e.output = append(e.output, 0xc0|byte(n-3), byte(pos), byte(pos>>8))
+	default:
+		e.output = append(e.output, 0xff, byte(n), byte(n>>8), byte(pos), byte(pos>>8))
+	}
+}
+
+func (e *lcwEncoder) encode() []byte {
+	if e.relative {
+		e.output = append(e.output, 0x00)
+	}
+	i := 0
+	for i < len(e.input) {
+		run := e.runLength(i)
+		n, src := e.longestMatch(i)
+		switch {
+		case run >= lcwMinFill && run >= n:
+			e.flushLiterals(i)
+			e.output = append(e.output, 0xfe, byte(run), byte(run>>8), e.input[i])
+			n = run
+		case n >= 3 && e.copyCost(n, src, i) < n:
+			e.flushLiterals(i)
+			e.emitCopy(n, src, i)
+		default:
+			n = 1 // Stays pending as a literal
+		}
+		for range n {
+			e.insert(i)
+			i++
+		}
+		if n > 1 {
+			e.literals = i
+		}
+	}
+	e.flushLiterals(len(e.input))
+	return append(e.output, 0x80)
+}
+
+// Compresses data with Westwood's LCW (Format80) scheme. In relative
+// mode the stream starts with a 0 byte and medium and long copies are
+// relative to the current position rather than to the start of the
+// output. Absolute mode can only refer back to the first 64K of the
+// output with those copies.
+func CompressLCW(data []byte, relative bool) []byte {
+	e := &lcwEncoder{
+		input:    data,
+		output:   make([]byte, 0, len(data)/2),
+		relative: relative,
+		head:     make([]int32, 1<<lcwHashBits),
+		prev:     make([]int32, len(data)),
+	}
+	for i := range e.head {
+		e.head[i] = -1
+	}
+	return e.encode()
+}
+
+// Builds a complete CMP/CPS file from raw 8 bit pixels. The 10 byte
+// header is followed by the LCW compressed pixels.
+func EncodeCmp(pixels []byte, relative bool) ([]byte, error) {
+	if len(pixels) > MaxCmpSize {
+		return nil, fmt.Errorf("image too large for a CMP file: %d bytes, at most %d", len(pixels), MaxCmpSize)
+	}
+	body := CompressLCW(pixels, relative)
+	size := 10 + len(body)
+	if size-2 > 0xffff {
+		return nil, fmt.Errorf("compressed image too large for a CMP file: %d bytes", size)
+	}
+	ret := make([]byte, 10, size)
+	binary.LittleEndian.PutUint16(ret[0:2], uint16(size-2))
+	binary.LittleEndian.PutUint16(ret[2:4], CmpLCW)
+	binary.LittleEndian.PutUint32(ret[4:8], uint32(len(pixels)))
+	binary.LittleEndian.PutUint16(ret[8:10], 0)
+	CmpLogger.Debug("Encoded CMP", "uncompressed", len(pixels), "compressed", size)
+	return append(ret, body...), nil
+}
+
+// Builds a CMP/CPS file from the colour indices of img, row by row
+func EncodeCmpImage(img *image.Paletted, relative bool) ([]byte, error) {
+	b := img.Bounds()
+	pixels := make([]byte, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		offset := img.PixOffset(b.Min.X, y)
+		pixels = append(pixels, img.Pix[offset:offset+b.Dx()]...)
+	}
+	return EncodeCmp(pixels, relative)
+}
+
+var (
+	ErrLCWTruncated = errors.New("LCW command runs past the end of the input")
+	ErrLCWOverflow  = errors.New("LCW command writes past the end of the output")
+	ErrLCWBadSource = errors.New("LCW copy from outside the output")
+)
+
+// A problem with an LCW stream
+type LCWError struct {
+	Offset  int    // Position of the command in the compressed stream
+	Output  int    // Output position when the command was reached
+	Command string // C1 to C5 as in the reference decoder
+	Err     error
+}
+
+func (e *LCWError) Error() string {
+	return fmt.Sprintf("%v: %s command at offset %d (output position %d)", e.Err, e.Command, e.Offset, e.Output)
+}
+
+func (e *LCWError) Unwrap() error {
+	return e.Err
+}
+
+// Set from AssetLoaderConfig.TraceLCW
+var traceLCW bool
+
+// Decompresses an LCW (Format80) stream into output and returns the
+// number of bytes written. A stream starting with 0 uses relative
+// medium and long copies. Every command is checked against the input
+// and output sizes so corrupt data gives an *LCWError rather than a
+// panic. Nothing is allocated unless the stream is corrupt.
+func DecodeLCW(input []byte, output []byte) (int, error) {
+	return decodeLCW(input, output, nil)
+}
+
+// Like DecodeLCW but logs every command to logger at debug level. Meant
+// for looking into broken files. It's several times slower.
+func DecodeLCWTraced(input []byte, output []byte, logger *slog.Logger) (int, error) {
+	return decodeLCW(input, output, logger)
+}
+
+// Logs a decoded command
+func traceCommand(logger *slog.Logger, command string, id int, input []byte, inputPos int, size int, outputPos int, outputSize int, args ...any) {
+	inDone := fmt.Sprintf("%04d/%04d (%.2f%%)", inputPos, len(input), (float64(inputPos)/float64(len(input)))*100)
+	opDone := fmt.Sprintf("%06d/%06d (%.2f%%)", outputPos, outputSize, (float64(outputPos)/float64(outputSize))*100)
+	pattern := utils.BytesToBinary(input[inputPos : inputPos+size])
+	logger.Debug(command+":", append([]any{"id", id, "indone", inDone, "opdone", opDone, "pattern", pattern}, args...)...)
+}
+
+func decodeLCW(input []byte, output []byte, trace *slog.Logger) (int, error) {
+	inputPos := 0
+	outputPos := 0
+	relativeMode := len(input) != 0 && input[0] == 0x0
+	commandCount := 0
+
+	if relativeMode {
+		inputPos += 1
+	}
+	if trace != nil && !trace.Enabled(context.Background(), slog.LevelDebug) {
+		trace = nil
+	}
+	if trace != nil {
+		trace.Debug("Decoding LCW", "relative", relativeMode, "input", len(input), "output", len(output))
+	}
+
+	for inputPos < len(input) {
+		commandCount += 1
+		begin := inputPos
+		current := input[inputPos]
+		switch {
+		case current == 0x80:
+			if trace != nil {
+				trace.Debug("End of stream")
+			}
+			return outputPos, nil
+		case current&0x80 == 0:
+			// Copy count bytes in output buffer from outputPos - pos to outputPos
+			if begin+2 > len(input) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C2", Err: ErrLCWTruncated}
+			}
+			count := int((current&0x70)>>4) + 3
+			source := outputPos - (int(current&0x0f)<<8 | int(input[inputPos+1])) // 12 bits of distance
+			if trace != nil {
+				traceCommand(trace, "C2", commandCount, input, begin, 2, outputPos, len(output), "count", count, "from", source)
+			}
+			if source < 0 || source+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C2", Err: ErrLCWBadSource}
+			}
+			if outputPos+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C2", Err: ErrLCWOverflow}
+			}
+			outputPos = lcwCopy(output, outputPos, source, count)
+			inputPos += 2
+		case current == 0xfe:
+			if begin+4 > len(input) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C4", Err: ErrLCWTruncated}
+			}
+			count := int(binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3]))
+			value := input[inputPos+3]
+			if trace != nil {
+				traceCommand(trace, "C4", commandCount, input, begin, 4, outputPos, len(output), "count", count, "value", value)
+			}
+			if outputPos+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C4", Err: ErrLCWOverflow}
+			}
+			fill := output[outputPos : outputPos+count]
+			for i := range fill {
+				fill[i] = value
+			}
+			outputPos += count
+			inputPos += 4
+		case current == 0xff:
+			if begin+5 > len(input) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C5", Err: ErrLCWTruncated}
+			}
+			count := int(binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3]))
+			target := int(binary.LittleEndian.Uint16(input[inputPos+3 : inputPos+5]))
+			if relativeMode {
+				target = outputPos - target
+			}
+			if trace != nil {
+				traceCommand(trace, "C5", commandCount, input, begin, 5, outputPos, len(output), "count", count, "to", target)
+			}
+			if target < 0 || target+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C5", Err: ErrLCWBadSource}
+			}
+			if outputPos+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C5", Err: ErrLCWOverflow}
+			}
+			outputPos = lcwCopy(output, outputPos, target, count)
+			inputPos += 5
+		case current&0xc0 == 0x80:
+			count := int(current & 0x3f)
+			if begin+count+1 > len(input) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C1", Err: ErrLCWTruncated}
+			}
+			if trace != nil {
+				traceCommand(trace, "C1", commandCount, input, begin, 1, outputPos, len(output), "count", count)
+			}
+			if outputPos+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C1", Err: ErrLCWOverflow}
+			}
+			outputPos += copy(output[outputPos:], input[inputPos+1:inputPos+1+count])
+			inputPos += count + 1
+		default: // 11cccccc
+			if begin+3 > len(input) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C3", Err: ErrLCWTruncated}
+			}
+			count := int(current&0x3f) + 3
+			target := int(binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3]))
+			if relativeMode {
+				target = outputPos - target
+			}
+			if trace != nil {
+				traceCommand(trace, "C3", commandCount, input, begin, 3, outputPos, len(output), "count", count, "to", target)
+			}
+			if target < 0 || target+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C3", Err: ErrLCWBadSource}
+			}
+			if outputPos+count > len(output) {
+				return outputPos, &LCWError{Offset: begin, Output: outputPos, Command: "C3", Err: ErrLCWOverflow}
+			}
+			outputPos = lcwCopy(output, outputPos, target, count)
+			inputPos += 3
+		}
+	}
+	// Some streams just stop without an end marker
+	return outputPos, nil
+}
+
+// Copies count bytes from source to outputPos and returns the new
+// output position. Copies that overlap what they write repeat the
+// pattern between source and outputPos, so those go a byte at a time.
+func lcwCopy(output []byte, outputPos int, source int, count int) int {
+	if source+count <= outputPos || source >= outputPos+count {
+		return outputPos + copy(output[outputPos:outputPos+count], output[source:source+count])
+	}
+	for range count {
+		output[outputPos] = output[source]
+		outputPos += 1
+		source += 1
+	}
+	return outputPos
+}
@@ -0,0 +1,393 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/nibrahim/eye-of-the-gopher/internal/utils"
+)
+
+// Go port of LCW_Uncomp from scripts/westwood_lcw_test.cpp. Pointers
+// become indices into source and dest. dest is assumed to start on a 4
+// byte boundary so the word aligned fill writes the same bytes as the
+// original, including the 4 bytes it can write past the end of a run.
+// Like the original it trusts the stream completely.
+func lcwUncomp(source []byte, dest []byte) int {
+	sourcePtr, destPtr := 0, 0
+	for {
+		opCode := source[sourcePtr]
+		sourcePtr++
+		if opCode&0x80 == 0 {
+			// Short copy from destination
+			count := int(opCode>>4) + 3
+			copyPtr := destPtr - (int(source[sourcePtr]) + int(opCode&0x0f)<<8)
+			sourcePtr++
+			for ; count > 0; count-- {
+				dest[destPtr] = dest[copyPtr]
+				destPtr++
+				copyPtr++
+			}
+		} else if opCode&0x40 == 0 {
+			if opCode == 0x80 {
+				return destPtr
+			}
+			// Medium copy from source
+			for count := int(opCode & 0x3f); count > 0; count-- {
+				dest[destPtr] = source[sourcePtr]
+				destPtr++
+				sourcePtr++
+			}
+		} else if opCode == 0xfe {
+			// Long run
+			count := int(source[sourcePtr]) + int(source[sourcePtr+1])<<8
+			data := source[sourcePtr+2]
+			sourcePtr += 3
+
+			copyPtr := destPtr + 4 - destPtr&0x3
+			count -= copyPtr - destPtr
+			for destPtr < copyPtr {
+				dest[destPtr] = data
+				destPtr++
+			}
+			wordDestPtr := destPtr
+			destPtr += count &^ 0x3
+			for wordDestPtr < destPtr {
+				for i := range 8 {
+					dest[wordDestPtr+i] = data
+				}
+				wordDestPtr += 8
+			}
+			copyPtr = destPtr + count&0x3
+			for destPtr < copyPtr {
+				dest[destPtr] = data
+				destPtr++
+			}
+		} else if opCode == 0xff {
+			// Long copy from destination
+			count := int(source[sourcePtr]) + int(source[sourcePtr+1])<<8
+			copyPtr := int(source[sourcePtr+2]) + int(source[sourcePtr+3])<<8
+			sourcePtr += 4
+			for ; count > 0; count-- {
+				dest[destPtr] = dest[copyPtr]
+				destPtr++
+				copyPtr++
+			}
+		} else {
+			// Medium copy from destination
+			count := int(opCode&0x3f) + 3
+			copyPtr := int(source[sourcePtr]) + int(source[sourcePtr+1])<<8
+			sourcePtr += 2
+			for ; count > 0; count-- {
+				dest[destPtr] = dest[copyPtr]
+				destPtr++
+				copyPtr++
+			}
+		}
+	}
+}
+
+// Builds a random absolute mode stream of size bytes out of every
+// command type. Fills are at least 4 long since shorter ones underflow
+// the count in the reference decoder.
+func synthesizeLCW(rng *rand.Rand, size int) []byte {
+	var stream []byte
+	pos := 0
+	for pos < size {
+		left := size - pos
+		switch c := rng.IntN(5); {
+		case c == 0 || pos == 0 || left < 4: // C1
+			count := min(rng.IntN(63)+1, left)
+			stream = append(stream, 0x80|byte(count))
+			for range count {
+				stream = append(stream, byte(rng.IntN(8)))
+			}
+			pos += count
+		case c == 1: // C2
+			count := min(rng.IntN(8)+3, left)
+			dist := rng.IntN(min(pos, 4095)) + 1
+			stream = append(stream, byte((count-3)<<4)|byte(dist>>8), byte(dist))
+			pos += count
+		case c == 2 && pos <= 0xffff: // C3
+			count := min(rng.IntN(62)+3, left)
+			from := rng.IntN(pos)
+			stream = append(stream, 0xc0|byte(count-3), byte(from), byte(from>>8))
+			pos += count
+		case c == 3: // C4
+			count := min(rng.IntN(300)+4, left)
+			stream = append(stream, 0xfe, byte(count), byte(count>>8), byte(rng.IntN(256)))
+			pos += count
+		default: // C5
+			count := min(rng.IntN(2000)+1, left)
+			from := rng.IntN(min(pos, 0x10000))
+			stream = append(stream, 0xff, byte(count), byte(count>>8), byte(from), byte(from>>8))
+			pos += count
+		}
+	}
+	return append(stream, 0x80)
+}
+
+// Checks DecodeLCW against the reference on a valid stream
+func compareWithReference(t *testing.T, stream []byte, size int) {
+	expected := make([]byte, size+16)
+	n := lcwUncomp(stream, expected)
+	output := make([]byte, size)
+	m, err := DecodeLCW(stream, output)
+	if err != nil {
+		t.Fatalf("valid stream rejected: %v", err)
+	}
+	if m != n || !bytes.Equal(output, expected[:n]) {
+		t.Fatalf("output differs from the reference (%d vs %d bytes)", m, n)
+	}
+}
+
+// Generates streams from seed, some of them re-encoded with
+// CompressLCW, and checks that DecodeLCW gives the same output as the
+// reference decoder
+func FuzzLCWReference(f *testing.F) {
+	for seed := range uint64(20) {
+		f.Add(seed, uint32(seed*3571), seed%4 == 0)
+	}
+	f.Add(uint64(99), uint32(64000), false)
+	f.Add(uint64(99), uint32(64000), true)
+	f.Fuzz(func(t *testing.T, seed uint64, size uint32, reencode bool) {
+		rng := rand.New(rand.NewPCG(seed, seed))
+		stream := synthesizeLCW(rng, int(size%70000)+1)
+		pixels := make([]byte, int(size%70000)+1)
+		if reencode {
+			if _, err := DecodeLCW(stream, pixels); err != nil {
+				t.Fatalf("generated stream rejected: %v", err)
+			}
+			stream = CompressLCW(pixels, false)
+		}
+		compareWithReference(t, stream, len(pixels))
+	})
+}
+
+// Corrupt streams mustn't panic or write past the output and have to
+// fail with an *LCWError if they fail at all
+func FuzzDecodeLCW(f *testing.F) {
+	rng := rand.New(rand.NewPCG(1, 1))
+	for _, size := range []int{1, 100, 4096, 64000} {
+		stream := synthesizeLCW(rng, size)
+		f.Add(stream, uint32(size))
+		pixels := make([]byte, size)
+		DecodeLCW(stream, pixels)
+		f.Add(CompressLCW(pixels, true), uint32(size))
+	}
+	f.Fuzz(func(t *testing.T, stream []byte, size uint32) {
+		output := make([]byte, size%70000)
+		n, err := DecodeLCW(stream, output)
+		if n < 0 || n > len(output) {
+			t.Fatalf("returned %d bytes for a %d byte output", n, len(output))
+		}
+		var lcwErr *LCWError
+		if err != nil && !errors.As(err, &lcwErr) {
+			t.Fatalf("error isn't an *LCWError: %v", err)
+		}
+	})
+}
+
+// Every image EncodeCmp writes, in either mode, has to decode back to
+// the same pixels through a header describing it
+func TestEncodeCmpRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 3))
+	screen := make([]byte, 320*200)
+	for i := range screen {
+		screen[i] = byte((i%320)/7 + (i/320)/5)
+		if rng.IntN(10) == 0 {
+			screen[i] = byte(rng.IntN(256))
+		}
+	}
+	// Past 64K, where absolute copies can't reach
+	large := make([]byte, 150000)
+	for i := range large {
+		large[i] = byte(i/1000) ^ byte(rng.IntN(2))
+	}
+	samples := map[string][]byte{
+		"empty":  {},
+		"screen": screen,
+		"large":  large,
+	}
+	for name, pixels := range samples {
+		for _, relative := range []bool{false, true} {
+			data, err := EncodeCmp(pixels, relative)
+			if err != nil {
+				t.Fatalf("%s (relative %v): %v", name, relative, err)
+			}
+			decoded, err := DecodeCps(data)
+			if err != nil {
+				t.Fatalf("%s (relative %v) doesn't decode: %v", name, relative, err)
+			}
+			header := decoded.Header
+			if int(header.fileSize) != len(data)-2 || int(header.uncompressedSize) != len(pixels) ||
+				header.compressionType != CmpLCW || header.paletteSize != 0 {
+				t.Fatalf("%s (relative %v): wrong header for %d bytes: %s", name, relative, len(data), header)
+			}
+			if !bytes.Equal(decoded.Pixels, pixels) {
+				t.Fatalf("%s (relative %v): pixels don't match", name, relative)
+			}
+			if !bytes.Equal(DecodeCmp(name, data, nil), pixels) {
+				t.Fatalf("%s (relative %v): DecodeCmp doesn't match", name, relative)
+			}
+		}
+	}
+}
+
+// The decoder parseCmpBody used to be, kept to measure DecodeLCW
+// against. It formats progress strings and bit patterns for every
+// command whether or not debug logging is on, and allocates its output.
+func legacyDecodeLCW(input []byte, size int) []byte {
+	output := make([]byte, size)
+	inputPos := 0
+	outputPos := 0
+	relativeMode := input[0] == 0x0
+	if relativeMode {
+		inputPos += 1
+	}
+	commandCount := 0
+	CmpLogger.Debug("First byte", "pattern", utils.BytesToBinary([]byte{input[0]}))
+
+	for inputPos < len(input) {
+		commandCount += 1
+		inDone := fmt.Sprintf("%04d/%04d (%.2f%%)", inputPos, len(input), (float64(inputPos)/float64(len(input)))*100)
+		opDone := fmt.Sprintf("%06d/%06d (%.2f%%)", outputPos, len(output), (float64(outputPos)/float64(len(output)))*100)
+		current := input[inputPos]
+		if current == 0x80 {
+			CmpLogger.Debug("End of stream")
+			break
+		} else if (current & 0x80) == 0 {
+			pattern := utils.BytesToBinary([]byte{input[inputPos], input[inputPos+1]})
+			count := ((current & 0x70) >> 4) + 3
+			source := outputPos - (int(current&0x0f)<<8 + int(input[inputPos+1]))
+			CmpLogger.Debug("C2:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "from", source)
+			for range count {
+				output[outputPos] = output[source]
+				outputPos += 1
+				source += 1
+			}
+			inputPos += 2
+		} else if current == 0xfe {
+			pattern := utils.BytesToBinary([]byte{input[inputPos], input[inputPos+1], input[inputPos+2], input[inputPos+3]})
+			count := binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3])
+			value := input[inputPos+3]
+			CmpLogger.Debug("C4:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "value", value)
+			for range count {
+				output[outputPos] = value
+				outputPos += 1
+			}
+			inputPos += 4
+		} else if current == 0xff {
+			pattern := utils.BytesToBinary(input[inputPos : inputPos+5])
+			count := int(binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3]))
+			target := int(binary.LittleEndian.Uint16(input[inputPos+3 : inputPos+5]))
+			if relativeMode {
+				target = outputPos - target
+			}
+			CmpLogger.Debug("C5:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "to", target)
+			for range count {
+				output[outputPos] = output[target]
+				outputPos += 1
+				target += 1
+			}
+			inputPos += 5
+		} else if (current & 0xc0) == 0x80 {
+			pattern := utils.BytesToBinary([]byte{current})
+			count := current & 0x3f
+			CmpLogger.Debug("C1:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern)
+			inputPos += 1
+			for range count {
+				output[outputPos] = input[inputPos]
+				inputPos += 1
+				outputPos += 1
+			}
+		} else {
+			pattern := utils.BytesToBinary([]byte{input[inputPos], input[inputPos+1], input[inputPos+2]})
+			count := (current & 0x3f) + 3
+			target := int(binary.LittleEndian.Uint16(input[inputPos+1 : inputPos+3]))
+			if relativeMode {
+				target = outputPos - target
+			}
+			CmpLogger.Debug("C3:", "id", commandCount, "indone", inDone, "opdone", opDone, "count", count, "pattern", pattern, "to", target)
+			for range count {
+				output[outputPos] = output[target]
+				outputPos += 1
+				target += 1
+			}
+			inputPos += 3
+		}
+	}
+	return output
+}
+
+// LCW streams of full screen images of the kind the intro uses
+func fullScreenStreams() []struct {
+	name   string
+	stream []byte
+} {
+	rng := rand.New(rand.NewPCG(1, 1))
+	flat := make([]byte, 320*200)
+	gradient := make([]byte, 320*200)
+	noisy := make([]byte, 320*200)
+	for y := range 200 {
+		for x := range 320 {
+			flat[y*320+x] = byte(x / 80)
+			gradient[y*320+x] = byte((x/7 + y/5) % 32)
+			noisy[y*320+x] = gradient[y*320+x]
+			if rng.IntN(8) == 0 {
+				noisy[y*320+x] = byte(rng.IntN(256))
+			}
+		}
+	}
+	return []struct {
+		name   string
+		stream []byte
+	}{
+		{"flat", CompressLCW(flat, false)},
+		{"gradient", CompressLCW(gradient, false)},
+		{"gradient-relative", CompressLCW(gradient, true)},
+		{"noisy", CompressLCW(noisy, false)},
+	}
+}
+
+// Compares DecodeLCW with the old decoder and with tracing turned on.
+// Run with go test -bench DecodeLCW -run '^$'
+func BenchmarkDecodeLCW(b *testing.B) {
+	verbose := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	for _, image := range fullScreenStreams() {
+		output := make([]byte, 320*200)
+		if _, err := DecodeLCW(image.stream, output); err != nil || !bytes.Equal(output, legacyDecodeLCW(image.stream, len(output))) {
+			b.Fatalf("%s: the decoders don't agree: %v", image.name, err)
+		}
+		b.Run(image.name+"/fast", func(b *testing.B) {
+			b.SetBytes(int64(len(output)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := DecodeLCW(image.stream, output); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(image.name+"/legacy", func(b *testing.B) {
+			b.SetBytes(int64(len(output)))
+			b.ReportAllocs()
+			for b.Loop() {
+				legacyDecodeLCW(image.stream, len(output))
+			}
+		})
+		b.Run(image.name+"/traced", func(b *testing.B) {
+			b.SetBytes(int64(len(output)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := DecodeLCWTraced(image.stream, output, verbose); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
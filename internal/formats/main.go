@@ -10,7 +10,11 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/audio"
@@ -27,6 +31,7 @@ type AssetLoaderConfig struct {
 	MazLevel   slog.Level
 	PakLevel   slog.Level
 	PalLevel   slog.Level
+	TraceLCW   bool // Log every LCW command while decoding images. Slow
 }
 
 var (
@@ -37,8 +42,37 @@ var (
 	PalLogger    *slog.Logger
 )
 
+// An asset is either already in memory or gets read through open
+// the first time somebody asks for it
+type assetEntry struct {
+	data    []byte
+	open    func() ([]byte, error)
+	size    int64
+	modTime time.Time // Only set for sideloaded files
+}
+
+// The assets from a single PAK file or sideloaded directory. rescan
+// is set for layers whose files can change while the game runs.
+type assetLayer struct {
+	source  string
+	entries map[string]*assetEntry
+	rescan  func() (map[string]*assetEntry, error)
+}
+
 type Assets struct {
-	assets map[string][]byte
+	mu     sync.Mutex
+	layers []*assetLayer // In load order. Assets in later layers override ones in earlier layers
+	files  []io.Closer   // Open PAK and zip files backing lazily loaded entries
+
+	sprites           spriteCache
+	paletteConversion PaletteConversion
+}
+
+// An asset name provided by more than one source. Sources are in
+// load order so the last one is what lookups return.
+type AssetConflict struct {
+	Name    string
+	Sources []string
 }
 
 // type PixelIterator func() (image.Point, bool)
@@ -46,8 +80,210 @@ type FadeIterator func() (*ebiten.Image, bool)
 
 func NewAssets() *Assets {
 	return &Assets{
-		assets: make(map[string][]byte),
+		layers: []*assetLayer{},
+	}
+}
+
+// Turns an asset name into the form used as a key. Like DOS, case
+// doesn't matter and either / or \ can separate directories.
+func NormaliseName(name string) string {
+	name = strings.ToUpper(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	return name
+}
+
+// Adds a new layer on top of the existing ones for the assets from
+// source
+func (a *Assets) addLayer(source string) *assetLayer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ret := &assetLayer{
+		source:  source,
+		entries: make(map[string]*assetEntry),
+	}
+	a.layers = append(a.layers, ret)
+	a.sprites.invalidate() // The new layer may shadow images or palettes
+	return ret
+}
+
+// Adds an asset that is already in memory
+func (a *Assets) put(layer *assetLayer, name string, data []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	layer.entries[NormaliseName(name)] = &assetEntry{data: data, size: int64(len(data))}
+}
+
+// Adds an asset of the given size that will be read using open on
+// first access
+func (a *Assets) putLazy(layer *assetLayer, name string, size int64, open func() ([]byte, error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	layer.entries[NormaliseName(name)] = &assetEntry{open: open, size: size}
+}
+
+// Finds the topmost layer that has name. Caller must hold a.mu.
+func (a *Assets) find(name string) (*assetEntry, *assetLayer) {
+	name = NormaliseName(name)
+	for i := len(a.layers) - 1; i >= 0; i-- {
+		if entry, exists := a.layers[i].entries[name]; exists {
+			return entry, a.layers[i]
+		}
+	}
+	return nil, nil
+}
+
+// Returns the contents of an asset, reading it in if this is the
+// first access
+func (a *Assets) lookup(name string) ([]byte, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, layer := a.find(name)
+	if entry == nil {
+		return nil, false
+	}
+	if entry.open != nil {
+		data, err := entry.open()
+		if err != nil {
+			AssetsLogger.Error("Couldn't read asset", "name", name, "source", layer.source, "error", err)
+			return nil, false
+		}
+		AssetsLogger.Debug("Read lazily loaded asset", "name", name, "source", layer.source, "size", len(data))
+		entry.data = data
+		entry.open = nil
+	}
+	AssetsLogger.Debug("Asset found", "name", name, "source", layer.source)
+	return entry.data, true
+}
+
+// Returns the size of an asset without loading it
+func (a *Assets) size(name string) (int64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, _ := a.find(name)
+	if entry == nil {
+		return 0, false
+	}
+	return entry.size, true
+}
+
+// Returns the names of all assets without loading any of them
+func (a *Assets) names() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	seen := make(map[string]bool)
+	ret := []string{}
+	for _, layer := range a.layers {
+		for k := range layer.entries {
+			if !seen[k] {
+				seen[k] = true
+				ret = append(ret, k)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Returns the PAK file or directory that name will be loaded from
+func (a *Assets) Source(name string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, layer := a.find(name)
+	if layer == nil {
+		return "", false
+	}
+	return layer.source, true
+}
+
+// Returns all the sources assets have been loaded from, in load order
+func (a *Assets) Sources() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ret := make([]string, 0, len(a.layers))
+	for _, layer := range a.layers {
+		ret = append(ret, layer.source)
+	}
+	return ret
+}
+
+// Lists every asset name that is provided by more than one source,
+// sorted by name
+func (a *Assets) Conflicts() []AssetConflict {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sources := make(map[string][]string)
+	for _, layer := range a.layers {
+		for k := range layer.entries {
+			sources[k] = append(sources[k], layer.source)
+		}
+	}
+	ret := []AssetConflict{}
+	for name, s := range sources {
+		if len(s) > 1 {
+			ret = append(ret, AssetConflict{Name: name, Sources: s})
+		}
 	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+// Checks sideloaded directories for files that were added, removed or
+// changed since they were loaded and updates the assets to match.
+// Changed files are read again the next time they're used. Returns
+// the names of the assets that changed.
+func (a *Assets) Reload() ([]string, error) {
+	a.mu.Lock()
+	layers := slices.Clone(a.layers)
+	a.mu.Unlock()
+
+	changed := []string{}
+	for _, layer := range layers {
+		if layer.rescan == nil {
+			continue
+		}
+		fresh, err := layer.rescan()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't rescan %s: %w", layer.source, err)
+		}
+		a.mu.Lock()
+		for name, entry := range fresh {
+			old, exists := layer.entries[name]
+			if !exists || old.size != entry.size || !old.modTime.Equal(entry.modTime) {
+				AssetsLogger.Info("Sideloaded asset changed", "name", name, "source", layer.source)
+				layer.entries[name] = entry
+				changed = append(changed, name)
+			}
+		}
+		for name := range layer.entries {
+			if _, exists := fresh[name]; !exists {
+				AssetsLogger.Info("Sideloaded asset removed", "name", name, "source", layer.source)
+				delete(layer.entries, name)
+				changed = append(changed, name)
+			}
+		}
+		a.mu.Unlock()
+	}
+	slices.Sort(changed)
+	changed = slices.Compact(changed)
+	if len(changed) != 0 {
+		a.sprites.invalidate(changed...)
+	}
+	return changed, nil
+}
+
+// Closes the PAK and zip files held open for lazily loaded assets. Assets
+// that haven't been read yet can't be used after this.
+func (a *Assets) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ret error
+	for _, f := range a.files {
+		if err := f.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	a.files = nil
+	return ret
 }
 
 type Sprite struct {
@@ -60,6 +296,12 @@ func (s *Sprite) GetEbitenImage() *ebiten.Image {
 	return ret
 }
 
+// The colour indices of sprites decoded from CMP and CPS images
+func (s *Sprite) Paletted() (*image.Paletted, bool) {
+	img, ok := s.Image.(*image.Paletted)
+	return img, ok
+}
+
 func (s *Sprite) GetImageRegion(x0, y0, x1, y1 int) *Sprite {
 	img := ebiten.NewImageFromImage(s.Image)
 	srcRect := image.Rect(x0, y0, x1, y1)
@@ -195,7 +437,7 @@ func (a *AudioTrack) String() string {
 func (a *Assets) GetAudioTrack(name string) (*AudioTrack, error) {
 	ext := strings.ToLower(path.Ext(name))
 	AssetsLogger.Debug("Loading track", "name", name, "extension", ext)
-	data, exists := a.assets[name]
+	data, exists := a.lookup(name)
 	if exists {
 		switch ext {
 		case ".adl":
@@ -228,9 +470,12 @@ func (a *Assets) GetPalette(name string) (color.Palette, error) {
 	if ext != ".pal" && ext != ".col" {
 		return nil, fmt.Errorf("cannot fetch %s as a sprite. Only PAL and COL", name)
 	} else {
-		data, exists := a.assets[name]
+		data, exists := a.lookup(name)
 		if exists {
-			pal := DecodePalette(data)
+			pal, err := DecodePaletteWith(data, a.PaletteConversion())
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode palette %s: %w", name, err)
+			}
 			return pal, nil
 		} else {
 			return nil, fmt.Errorf("cannot fetch %s: No such asset", name)
@@ -238,57 +483,123 @@ func (a *Assets) GetPalette(name string) (color.Palette, error) {
 	}
 }
 
+// How CMP and CPS images are turned into sprites
+type SpriteOptions struct {
+	Transparent int // Palette index drawn transparent. NoTransparency for opaque images
+}
+
+// Loads a CMP, CPS or PNG image as a sprite. CMP and CPS images use
+// the palette named by paletteName or, if that's empty, the palette
+// embedded in the file. Colour 0 is transparent.
 func (a *Assets) GetSprite(name string, paletteName string, width uint, height uint, prefix string) (*Sprite, error) {
-	palette, err := a.GetPalette(paletteName)
+	return a.GetSpriteWithOptions(name, paletteName, width, height, prefix, SpriteOptions{})
+}
+
+// Like GetSprite. CMP and CPS images become an *image.Paletted that keeps
+// the colour indices, with transparency as given in opts. Sprites are
+// cached, so the same *Sprite comes back for the same arguments and its
+// Image must not be modified.
+func (a *Assets) GetSpriteWithOptions(name string, paletteName string, width uint, height uint, prefix string, opts SpriteOptions) (*Sprite, error) {
+	key := spriteKey{
+		name:    NormaliseName(name),
+		palette: NormaliseName(paletteName),
+		width:   width,
+		height:  height,
+		opts:    opts,
+	}
+	if paletteName == "" {
+		key.palette = ""
+	}
+	sprite, generation := a.sprites.get(key)
+	if sprite != nil {
+		return sprite, nil
+	}
+	sprite, err := a.decodeSprite(name, paletteName, width, height, opts)
 	if err != nil {
-		PakLogger.Error("Couldn't load palette", "name", paletteName)
+		return nil, err
 	}
+	a.sprites.add(key, sprite, generation)
+	return sprite, nil
+}
+
+// Sets how palettes are scaled from the 6 bit VGA values. Defaults to
+// PaletteExact.
+func (a *Assets) SetPaletteConversion(conversion PaletteConversion) {
+	a.mu.Lock()
+	a.paletteConversion = conversion
+	a.mu.Unlock()
+	a.sprites.invalidate()
+}
+
+func (a *Assets) PaletteConversion() PaletteConversion {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.paletteConversion
+}
+
+// Drops cached sprites made from any of the named images or palettes, or
+// every cached sprite if no names are given
+func (a *Assets) InvalidateSprites(names ...string) {
+	a.sprites.invalidate(names...)
+}
+
+func (a *Assets) decodeSprite(name string, paletteName string, width uint, height uint, opts SpriteOptions) (*Sprite, error) {
 	ext := strings.ToLower(path.Ext(name))
 	PakLogger.Debug("Loading sprite", "name", name, "extension", ext)
-	switch ext {
-	case ".cmp", ".cps":
-		data, exists := a.assets[name]
-		if exists {
-			imgData := DecodeCmp(name, data, palette)
-			img := CMPToImage(imgData, palette, int(width), int(height))
-			PakLogger.Debug("Sending back", "len", len(data))
-			return &Sprite{
-				name:  name,
-				Image: img,
-			}, nil
-		} else {
-			PakLogger.Warn("Couldn't load ", "name", name)
-			return nil, fmt.Errorf("cannot fetch %s: No such asset", name)
+	if ext != ".cmp" && ext != ".cps" && ext != ".png" {
+		return nil, fmt.Errorf("cannot fetch %s as a sprite. Only CPS, CMP or PNG", name)
+	}
+	data, exists := a.lookup(name)
+	if !exists {
+		PakLogger.Warn("Couldn't load ", "name", name)
+		return nil, fmt.Errorf("cannot fetch %s: No such asset", name)
+	}
+	var img image.Image
+	if ext == ".png" {
+		decoded, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			PakLogger.Error("couldn't decode image", "image", name)
+			return nil, fmt.Errorf("couldn't decode image %s: %w", name, err)
 		}
-	case ".png":
-		data, exists := a.assets[name]
-		if exists {
-			imgData := bytes.NewReader(data)
-			img, format, err := image.Decode(imgData)
-			img = resize.Resize(width, height, img, resize.Lanczos3)
-			PakLogger.Debug("Decoding image ", "name", name, "format", format)
+		PakLogger.Debug("Decoding image ", "name", name, "format", format)
+		img = resize.Resize(width, height, decoded, resize.Lanczos3)
+	} else {
+		// Decoded directly rather than through image.Decode, which would
+		// have to recognise the file from its header and then give it a
+		// palette only to have it replaced here
+		decoded, err := DecodeCps(data)
+		if err != nil {
+			PakLogger.Error("couldn't decode image", "image", name)
+			return nil, fmt.Errorf("couldn't decode image %s: %w", name, err)
+		}
+		palette := decoded.Palette
+		if paletteName != "" {
+			palette, err = a.GetPalette(paletteName)
 			if err != nil {
-				PakLogger.Error("couldn't decode image", "image", name)
-				return nil, fmt.Errorf("couldn't decoder image %s", name)
+				PakLogger.Error("Couldn't load palette", "name", paletteName)
+				return nil, fmt.Errorf("couldn't load palette for %s: %w", name, err)
+			}
+		} else if palette == nil {
+			return nil, fmt.Errorf("%s has no embedded palette and no palette was given", name)
+		} else if conversion := a.PaletteConversion(); conversion != PaletteExact {
+			palette, err = DecodePaletteWith(data[10:10+decoded.Header.PaletteSize()], conversion)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode palette embedded in %s: %w", name, err)
 			}
-			PakLogger.Debug("Sending back", "len", len(data))
-			return &Sprite{
-				name:  name,
-				Image: img,
-			}, nil
-		} else {
-			PakLogger.Warn("Couldn't load ", "name", name)
-			return nil, fmt.Errorf("cannot fetch %s: No such asset", name)
 		}
-	default:
-		return nil, fmt.Errorf("cannot fetch %s as a sprite. Only CPS, CMP or PNG", name)
+		img = CMPToPaletted(decoded.Pixels, palette, int(width), int(height), opts.Transparent)
 	}
-
+	PakLogger.Debug("Sending back", "len", len(data))
+	return &Sprite{
+		name:  name,
+		Image: img,
+	}, nil
 }
 
 func (a *Assets) DumpAssets() {
-	for k := range a.assets {
-		fmt.Println(k)
+	for _, k := range a.names() {
+		source, _ := a.Source(k)
+		fmt.Printf("%s\t%s\n", k, source)
 	}
 }
 
@@ -312,28 +623,44 @@ func SaveEbitenImage(img *ebiten.Image, filename string) error {
 	return png.Encode(f, rgba)
 }
 
-// Load assets from original EOB game. Game files should be in the provided directory
-func LoadAssets(classicAssetDir string, extraAssetDirs ...string) *Assets {
+// Load assets from original EOB game. Game files should be in the
+// provided directory. Fails with a *GameDataError if PAK files are
+// missing.
+func LoadAssets(classicAssetDir string, extraAssetDirs ...string) (*Assets, error) {
+	pakFiles, err := FindGameData(classicAssetDir)
+	if err != nil {
+		return nil, err
+	}
+
 	ret := NewAssets()
-	pakFilesNeeded := []string{"EOBDATA1.PAK", "EOBDATA2.PAK", "EOBDATA3.PAK", "EOBDATA4.PAK", "EOBDATA5.PAK", "EOBDATA6.PAK"}
-	for _, pakFile := range pakFilesNeeded {
-		t := path.Join(classicAssetDir, pakFile)
-		err := ret.LoadPakFile(t, "")
+	for _, pakFile := range EOBDataFiles {
+		t := pakFiles[pakFile]
+		err := ret.IndexPakFile(t, "")
 		if err != nil {
-			utils.ErrorAndExit("Couldn't load %s", t)
+			ret.Close()
+			return nil, fmt.Errorf("couldn't load %s: %w", t, err)
 		}
 	}
-	if len(extraAssetDirs) == 0 {
-		return ret
-	}
 	AssetsLogger.Debug("Loading extra assets")
 	for _, assetDir := range extraAssetDirs {
+		if assetDir == "" {
+			continue
+		}
 		prefix := path.Base(assetDir)
+		if strings.EqualFold(path.Ext(prefix), ".zip") {
+			prefix = strings.TrimSuffix(prefix, path.Ext(prefix))
+		}
 		AssetsLogger.Debug("Loading extra assets", "from", assetDir, "prefix", prefix)
-		ret.LoadExtraAssets(assetDir, prefix)
+		if err := ret.LoadExtraAssets(assetDir, prefix); err != nil {
+			ret.Close()
+			return nil, err
+		}
+	}
+	for _, conflict := range ret.Conflicts() {
+		AssetsLogger.Info("Asset overridden", "name", conflict.Name, "sources", conflict.Sources)
 	}
 
-	return ret
+	return ret, nil
 }
 
 func InitLogger(assetLogLevels AssetLoaderConfig) {
@@ -342,4 +669,5 @@ func InitLogger(assetLogLevels AssetLoaderConfig) {
 	PakLogger = utils.InitLogger("pak", assetLogLevels.PakLevel)
 	PalLogger = utils.InitLogger("pal", assetLogLevels.PalLevel)
 	AssetsLogger = utils.InitLogger("assets", assetLogLevels.AssetLevel)
+	traceLCW = assetLogLevels.TraceLCW
 }
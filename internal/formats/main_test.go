@@ -0,0 +1,142 @@
+package formats
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Keeps the loggers quiet. InitLogger would create log files.
+func TestMain(m *testing.M) {
+	quiet := slog.New(slog.DiscardHandler)
+	AssetsLogger, CmpLogger, MazLogger, PakLogger, PalLogger = quiet, quiet, quiet, quiet, quiet
+	m.Run()
+}
+
+// Writes a 2x2 PNG of a single colour. The modification time is set
+// to when so changes are seen whatever the file system's resolution.
+func writePNG(t *testing.T, name string, c color.Color, when time.Time) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := range 4 {
+		img.Set(i%2, i/2, c)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, name, buf.Bytes())
+	if err := os.Chtimes(name, when, when); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssetsReload(t *testing.T) {
+	dir := t.TempDir()
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	then := time.Now().Add(-time.Hour)
+	writePNG(t, filepath.Join(dir, "changed.png"), red, then)
+	writePNG(t, filepath.Join(dir, "removed.png"), red, then)
+	writePNG(t, filepath.Join(dir, "sub", "same.png"), red, then)
+
+	a := NewAssets()
+	if err := a.LoadExtraAssets(dir, "E"); err != nil {
+		t.Fatal(err)
+	}
+	changedSprite, err := a.GetSprite("E/CHANGED.PNG", "", 2, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSprite, err := a.GetSprite("E/SUB/SAME.PNG", "", 2, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := a.Reload()
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("nothing changed but got %v, %v", changed, err)
+	}
+
+	writePNG(t, filepath.Join(dir, "changed.png"), blue, time.Now())
+	if err := os.Remove(filepath.Join(dir, "removed.png")); err != nil {
+		t.Fatal(err)
+	}
+	writePNG(t, filepath.Join(dir, "sub", "added.png"), blue, time.Now())
+	changed, err = a.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"E/CHANGED.PNG", "E/REMOVED.PNG", "E/SUB/ADDED.PNG"}
+	if !slices.Equal(changed, want) {
+		t.Fatalf("got changes %v, want %v", changed, want)
+	}
+
+	sprite, err := a.GetSprite("E/CHANGED.PNG", "", 2, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sprite == changedSprite {
+		t.Fatal("changed sprite wasn't dropped from the cache")
+	}
+	if r, g, b, _ := sprite.Image.At(0, 0).RGBA(); r != 0 || g != 0 || b != 0xffff {
+		t.Fatalf("changed sprite wasn't decoded again: got %v", sprite.Image.At(0, 0))
+	}
+	if sprite, err := a.GetSprite("E/SUB/SAME.PNG", "", 2, 2, ""); err != nil || sprite != sameSprite {
+		t.Fatalf("unchanged sprite was dropped from the cache: %v", err)
+	}
+	if _, err := a.GetSprite("E/REMOVED.PNG", "", 2, 2, ""); err == nil {
+		t.Fatal("removed sprite can still be loaded")
+	}
+	if _, err := a.GetSprite("E/SUB/ADDED.PNG", "", 2, 2, ""); err != nil {
+		t.Fatalf("added sprite can't be loaded: %v", err)
+	}
+}
+
+// CMP/CPS sprites are decoded by extension, so files image.Decode
+// wouldn't recognise, like uncompressed images smaller than the screen,
+// load too
+func TestGetSpriteCps(t *testing.T) {
+	dir := t.TempDir()
+	pixels := []byte{0, 1, 2, 3, 3, 2, 1, 0}
+	palette := bytes.Repeat([]byte{0, 0, 0, 63, 0, 0, 0, 63, 0, 0, 0, 63}, 64)
+	lcw, err := EncodeCmp(pixels, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "lcw.cps"), cmpFile(CmpLCW, 8, palette, lcw[10:]))
+	writeFile(t, filepath.Join(dir, "raw.cmp"), cmpFile(CmpUncompressed, 8, palette, pixels))
+	writeFile(t, filepath.Join(dir, "bare.cps"), cmpFile(CmpUncompressed, 8, nil, pixels))
+	writeFile(t, filepath.Join(dir, "blue.pal"), bytes.Repeat([]byte{0, 0, 63}, 256))
+
+	a := NewAssets()
+	if err := a.LoadExtraAssets(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"LCW.CPS", "RAW.CMP"} {
+		sprite, err := a.GetSprite(name, "", 4, 2, "")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		img, ok := sprite.Paletted()
+		if !ok || !bytes.Equal(img.Pix, pixels) || img.Palette[3] != (color.RGBA{0, 0, 255, 255}) {
+			t.Fatalf("%s decoded wrongly", name)
+		}
+	}
+	if _, err := a.GetSprite("BARE.CPS", "", 4, 2, ""); err == nil {
+		t.Fatal("image without a palette decoded without one")
+	}
+	sprite, err := a.GetSprite("BARE.CPS", "BLUE.PAL", 4, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img, ok := sprite.Paletted(); !ok || !bytes.Equal(img.Pix, pixels) || img.Palette[1] != (color.RGBA{0, 0, 255, 255}) {
+		t.Fatal("BARE.CPS decoded wrongly with BLUE.PAL")
+	}
+}
@@ -1,146 +1,651 @@
 package formats
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 )
 
-func (a *Assets) LoadPakFile(pakfile string, prefix string) error {
-	filenames := []string{}
-	offsets := []uint32{}
-	PakLogger.Info("Loading Pakfile", "name", pakfile)
+// A single named file inside a PAK archive. Offset is where the data
+// was found when the archive was read and is ignored when writing.
+type PakEntry struct {
+	Name   string
+	Data   []byte
+	Offset uint32
+}
 
-	f, err := os.Open(pakfile)
-	if err != nil {
-		return fmt.Errorf("cannot open file: %w", err)
+// How the list of records at the start of a PAK file ends. The
+// different Westwood games don't agree on this.
+type PakVariant int
+
+const (
+	PakPlain          PakVariant = iota // The records run right up to the data of the first entry
+	PakZeroTerminated                   // The records end with a zero offset
+	PakSentinel                         // The records end with an offset equal to the size of the file and an empty name
+	PakSized                            // Each offset is followed by the size of the entry. The records end with a zero offset or where the data begins
+)
+
+func (v PakVariant) String() string {
+	switch v {
+	case PakPlain:
+		return "plain"
+	case PakZeroTerminated:
+		return "zero terminated"
+	case PakSentinel:
+		return "sentinel"
+	case PakSized:
+		return "sized"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(v))
 	}
-	defer f.Close()
+}
 
-	for { // The header will end when have some offsets/files and when we read past the first offset (i.e. when the data begins)
-		if len(offsets) != 0 {
-			firstOffset := offsets[0]
-			t, err := f.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return fmt.Errorf("error while finding current file position: %w", err)
-			}
+// The ordered contents of a PAK archive. Terminator holds whatever
+// sits between the last header record and the data of the first
+// entry (the terminating offset and any padding after it) so that
+// writing an archive back out reproduces the original byte for
+// byte. BigEndian is set for archives from big endian machines like
+// the Amiga.
+type PakArchive struct {
+	Entries    []PakEntry
+	Terminator []byte
+	Variant    PakVariant
+	BigEndian  bool
+}
 
-			currentPos := uint32(t)
-			if currentPos+4 >= firstOffset {
-				PakLogger.Debug("header completed")
-				break
-			}
+// Creates an empty archive that ends its header with a zero offset
+// like the original EOBDATA files do
+func NewPakArchive() *PakArchive {
+	return &PakArchive{
+		Entries:    []PakEntry{},
+		Terminator: []byte{0, 0, 0, 0},
+		Variant:    PakZeroTerminated,
+	}
+}
 
-		}
+// Longest entry name accepted while parsing. DOS names are 8.3 but
+// this leaves room for the odd path.
+const maxPakNameLength = 255
 
-		var offset uint32
-		err = binary.Read(f, binary.LittleEndian, &offset)
-		if err != nil {
-			return fmt.Errorf("unexpected short read while looking for offset: %w", err)
+// Entry names are printable ASCII
+func validPakNameChar(c byte) bool {
+	return c >= 0x20 && c <= 0x7e
+}
+
+// Checks that name is something parsePakHeader will read back
+func validPakName(name string) bool {
+	if name == "" || len(name) > maxPakNameLength {
+		return false
+	}
+	for i := range len(name) {
+		if !validPakNameChar(name[i]) {
+			return false
 		}
+	}
+	return true
+}
 
-		offsets = append(offsets, offset)
+var (
+	ErrPakTruncated  = errors.New("truncated PAK header")
+	ErrPakOverlap    = errors.New("overlapping or decreasing PAK offsets")
+	ErrPakOutOfRange = errors.New("PAK entry out of range")
+	ErrPakBadName    = errors.New("invalid PAK entry name")
+	ErrPakBadSize    = errors.New("PAK entry sizes don't match the offsets")
+)
 
-		var fnamechar byte
+// Describes what's wrong with a malformed PAK file. Err is one of the
+// ErrPak* errors so callers can use errors.Is.
+type PakError struct {
+	Pos   int64 // Position in the file where the problem was found
+	Entry int   // Index of the header record being parsed
+	Name  string
+	Err   error
+}
 
-		err = binary.Read(f, binary.LittleEndian, &fnamechar)
-		if err != nil {
-			return fmt.Errorf("unexpected short read while looking for name: %w", err)
+func (e *PakError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("%v: entry %d (%s) at position %d", e.Err, e.Entry, e.Name, e.Pos)
+	}
+	return fmt.Sprintf("%v: entry %d at position %d", e.Err, e.Entry, e.Pos)
+}
+
+func (e *PakError) Unwrap() error {
+	return e.Err
+}
+
+// The offset/name records at the start of a PAK file. Entry i runs
+// from offsets[i] to offsets[i+1] and the last one runs to the end of
+// the file. sizes is only set for PakSized archives.
+type pakHeader struct {
+	names     []string
+	offsets   []uint32
+	sizes     []uint32
+	headerEnd uint32 // Position just after the last record
+	size      uint32 // Size of the whole file
+	variant   PakVariant
+	order     binary.ByteOrder
+}
+
+// Returns the start and end of entry i
+func (h *pakHeader) span(i int) (uint32, uint32) {
+	if h.sizes != nil {
+		return h.offsets[i], h.offsets[i] + h.sizes[i]
+	}
+	if i+1 == len(h.offsets) {
+		return h.offsets[i], h.size
+	}
+	return h.offsets[i], h.offsets[i+1]
+}
+
+// Reads the bytes from start to end. Empty spans at the very end of the
+// file are fine.
+func readSpan(r io.ReaderAt, start uint32, end uint32) ([]byte, error) {
+	data := make([]byte, end-start)
+	if len(data) == 0 {
+		return data, nil
+	}
+	n, err := r.ReadAt(data, int64(start))
+	if n == len(data) {
+		return data, nil
+	}
+	return nil, err
+}
+
+// Reads and validates the header of a PAK file of the given size.
+// Offsets have to be in order and inside the file, names have to be
+// printable and the data mustn't start inside the header. The records
+// end at a zero offset, at an offset equal to the file size followed
+// by an empty name or where the data of the first entry begins,
+// whichever comes first. An offset equal to the file size with a name
+// is a real empty entry at the end of the archive. Offsets
+// are little endian unless the first one only makes sense as a big
+// endian number.
+//
+// Headers that don't make sense are tried again as PakSized headers,
+// where each offset is followed by the size of the entry. The sizes
+// have to add up to the offsets for those to be accepted. If neither
+// works the error is the one from the plain layout.
+func parsePakHeader(r io.ReaderAt, size int64) (*pakHeader, error) {
+	header, err := parsePakRecords(r, size, false)
+	if err == nil {
+		return header, nil
+	}
+	if sized, sizedErr := parsePakRecords(r, size, true); sizedErr == nil {
+		return sized, nil
+	}
+	return nil, err
+}
+
+func parsePakRecords(r io.ReaderAt, size int64, sized bool) (*pakHeader, error) {
+	if size > math.MaxUint32 {
+		return nil, &PakError{Pos: 0, Err: ErrPakOutOfRange}
+	}
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	ret := &pakHeader{size: uint32(size), variant: PakPlain, order: binary.LittleEndian}
+	recordSize := int64(4) // Bytes before the name
+	if sized {
+		ret.variant = PakSized
+		ret.sizes = []uint32{}
+		recordSize = 8
+	}
+	var pos int64
+
+	for {
+		entry := len(ret.offsets)
+		if entry != 0 && pos+recordSize > int64(ret.offsets[0]) { // No room for another record before the data begins
+			break
+		}
+
+		var buf [4]byte
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			return nil, &PakError{Pos: pos, Entry: entry, Err: ErrPakTruncated}
+		}
+		if entry == 0 && int64(binary.LittleEndian.Uint32(buf[:])) > size && int64(binary.BigEndian.Uint32(buf[:])) <= size {
+			PakLogger.Debug("Big endian offsets")
+			ret.order = binary.BigEndian
+		}
+		offset := ret.order.Uint32(buf[:])
+		if entry != 0 && offset == 0 {
+			if !sized {
+				ret.variant = PakZeroTerminated
+			}
+			break
+		}
+		if !sized && entry != 0 && int64(offset) == size && pos+5 <= int64(ret.offsets[0]) {
+			if next, err := br.Peek(1); err == nil && next[0] == 0 {
+				ret.variant = PakSentinel
+				break
+			}
+		}
+		if !sized && entry != 0 && pos+4 == int64(ret.offsets[0]) { // Whatever this is, the data begins right after it
+			break
+		}
+		if int64(offset) > size {
+			return nil, &PakError{Pos: pos, Entry: entry, Err: ErrPakOutOfRange}
+		}
+		if entry != 0 && offset < ret.offsets[entry-1] {
+			return nil, &PakError{Pos: pos, Entry: entry, Err: ErrPakOverlap}
+		}
+		pos += 4
+		if sized {
+			if _, err := io.ReadFull(br, buf[:]); err != nil {
+				return nil, &PakError{Pos: pos, Entry: entry, Err: ErrPakTruncated}
+			}
+			entrySize := ret.order.Uint32(buf[:])
+			if int64(offset)+int64(entrySize) > size {
+				return nil, &PakError{Pos: pos, Entry: entry, Err: ErrPakOutOfRange}
+			}
+			ret.sizes = append(ret.sizes, entrySize)
+			pos += 4
 		}
 
-		fnamechars := make([]byte, 0)
-		fnamechars = append(fnamechars, fnamechar)
+		fnamechars := make([]byte, 0, 13)
 		for {
-			err = binary.Read(f, binary.LittleEndian, &fnamechar)
+			fnamechar, err := br.ReadByte()
+			if err != nil {
+				return nil, &PakError{Pos: pos, Entry: entry, Name: string(fnamechars), Err: ErrPakTruncated}
+			}
+			pos += 1
 			if fnamechar == 0 {
 				break
 			}
-			if err != nil {
-				return fmt.Errorf("unexpected short read while looking for name: %w", err)
+			if !validPakNameChar(fnamechar) || len(fnamechars) == maxPakNameLength {
+				return nil, &PakError{Pos: pos - 1, Entry: entry, Name: string(fnamechars), Err: ErrPakBadName}
 			}
 			fnamechars = append(fnamechars, fnamechar)
 		}
+		if len(fnamechars) == 0 {
+			return nil, &PakError{Pos: pos - 1, Entry: entry, Err: ErrPakBadName}
+		}
 		fname := string(fnamechars)
-		filenames = append(filenames, fname)
+		ret.offsets = append(ret.offsets, offset)
+		ret.names = append(ret.names, fname)
 		PakLogger.Debug("Entry parsed", "offset", offset, "name", fname)
 	}
 
+	PakLogger.Debug("header completed", "variant", ret.variant, "byteorder", ret.order)
+	ret.headerEnd = uint32(pos)
+	if ret.offsets[0] < ret.headerEnd {
+		return nil, &PakError{Pos: pos, Entry: 0, Name: ret.names[0], Err: ErrPakOverlap}
+	}
+	if sized {
+		for i := range ret.offsets {
+			next := ret.size
+			if i+1 < len(ret.offsets) {
+				next = ret.offsets[i+1]
+			}
+			if ret.offsets[i]+ret.sizes[i] != next {
+				return nil, &PakError{Pos: int64(ret.offsets[i]), Entry: i, Name: ret.names[i], Err: ErrPakBadSize}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Parses a whole PAK archive of the given size from r
+func ParsePak(r io.ReaderAt, size int64) (*PakArchive, error) {
+	header, err := parsePakHeader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	terminator, err := readSpan(r, header.headerEnd, header.offsets[0])
+	if err != nil {
+		return nil, fmt.Errorf("short read on header terminator: %w", err)
+	}
+	ret := &PakArchive{
+		Entries:    make([]PakEntry, 0, len(header.offsets)),
+		Terminator: terminator,
+		Variant:    header.variant,
+		BigEndian:  header.order == binary.BigEndian,
+	}
+
+	for i, name := range header.names {
+		start, end := header.span(i)
+		data, err := readSpan(r, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("short read while unpacking %s (position : %d): %w", name, i, err)
+		}
+		ret.Entries = append(ret.Entries, PakEntry{Name: name, Data: data, Offset: start})
+	}
+	return ret, nil
+}
+
+// Reads every entry of pakfile, in archive order
+func ReadPak(pakfile string) (*PakArchive, error) {
+	PakLogger.Info("Reading Pakfile", "name", pakfile)
+	f, err := os.Open(pakfile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+
 	stat, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("could not stat file: %w", err)
+		return nil, fmt.Errorf("could not stat file: %w", err)
 	}
 
-	fileLimit := uint64(stat.Size())
+	ret, err := ParsePak(f, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", pakfile, err)
+	}
+	return ret, nil
+}
 
-	for i := range len(offsets) {
-		filename := filenames[i]
-		start := uint64(offsets[i])
-		var end uint64
-		if i+1 == len(offsets) {
-			end = fileLimit
-		} else {
-			end = uint64(offsets[i+1])
+// Replaces the data of the entry called name or appends a new entry
+// if there's no such entry
+func (p *PakArchive) Set(name string, data []byte) {
+	for i := range p.Entries {
+		if strings.EqualFold(p.Entries[i].Name, name) {
+			p.Entries[i].Data = data
+			return
 		}
-		PakLogger.Debug("Extracting", "file", filename, "From", start, "To", end)
-		_, err = f.Seek(int64(start), io.SeekStart)
-		if err != nil {
-			return fmt.Errorf("could not extract %s from %s at offset %d: %w", filename, pakfile, start, err)
+	}
+	p.Entries = append(p.Entries, PakEntry{Name: name, Data: data})
+}
+
+// Writes the archive in PAK format. The header is a uint32 offset
+// (and a uint32 size for PakSized archives) followed by the NUL
+// terminated name of each entry, then the
+// terminator and then the entry data in the same order. For
+// PakSentinel archives the first four bytes of the terminator are
+// replaced with the new size of the file and the fifth has to be the
+// NUL of the empty name after it.
+func (p *PakArchive) Write(w io.Writer) error {
+	if len(p.Entries) == 0 {
+		return fmt.Errorf("cannot write a PAK file with no entries")
+	}
+	if (p.Variant == PakZeroTerminated || p.Variant == PakSentinel) && len(p.Terminator) < 4 {
+		return fmt.Errorf("%s PAK file needs at least 4 terminator bytes, have %d", p.Variant, len(p.Terminator))
+	}
+	if p.Variant == PakSentinel && (len(p.Terminator) < 5 || p.Terminator[4] != 0) {
+		return fmt.Errorf("sentinel PAK file needs the size followed by an empty name in its terminator")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if p.BigEndian {
+		order = binary.BigEndian
+	}
+
+	recordSize := uint64(4)
+	if p.Variant == PakSized {
+		recordSize = 8
+	}
+	headerSize := uint64(len(p.Terminator))
+	for _, entry := range p.Entries {
+		if !validPakName(entry.Name) {
+			return fmt.Errorf("invalid PAK entry name %q: names have to be 1 to %d printable ASCII characters", entry.Name, maxPakNameLength)
 		}
-		data := make([]byte, end-start)
-		n, err := f.Read(data)
-		if err != nil || n != len(data) {
-			return fmt.Errorf("short read while unpacking %s (position : %d): %w", filename, i, err)
+		headerSize += recordSize + uint64(len(entry.Name)) + 1
+	}
+
+	bw := bufio.NewWriter(w)
+	offset := headerSize
+	for _, entry := range p.Entries {
+		if offset > math.MaxUint32 {
+			return fmt.Errorf("PAK file too large: %s starts beyond 4GB", entry.Name)
+		}
+		binary.Write(bw, order, uint32(offset))
+		if p.Variant == PakSized {
+			binary.Write(bw, order, uint32(len(entry.Data)))
+		}
+		bw.WriteString(entry.Name)
+		bw.WriteByte(0)
+		offset += uint64(len(entry.Data))
+	}
+	if offset > math.MaxUint32 {
+		return fmt.Errorf("PAK file too large: %d bytes", offset)
+	}
+	terminator := p.Terminator
+	if p.Variant == PakSentinel {
+		terminator = bytes.Clone(p.Terminator)
+		order.PutUint32(terminator, uint32(offset))
+	}
+	bw.Write(terminator)
+	for _, entry := range p.Entries {
+		bw.Write(entry.Data)
+	}
+	return bw.Flush()
+}
+
+// Writes the archive into a file called pakfile
+func (p *PakArchive) WritePakFile(pakfile string) error {
+	PakLogger.Info("Writing Pakfile", "name", pakfile, "entries", len(p.Entries))
+	f, err := os.Create(pakfile)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	if err = p.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write %s: %w", pakfile, err)
+	}
+	return f.Close()
+}
+
+// Reads every entry of pakfile into memory
+func (a *Assets) LoadPakFile(pakfile string, prefix string) error {
+	return a.addPakFile(pakfile, prefix, false)
+}
+
+// Reads only the header of pakfile. The file is kept open and each
+// entry is read the first time it's asked for. Call Close once the
+// assets are no longer needed.
+func (a *Assets) IndexPakFile(pakfile string, prefix string) error {
+	return a.addPakFile(pakfile, prefix, true)
+}
 
+func (a *Assets) addPakFile(pakfile string, prefix string, lazy bool) error {
+	PakLogger.Info("Loading Pakfile", "name", pakfile, "lazy", lazy)
+
+	f, err := os.Open(pakfile)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %w", err)
+	}
+	keepOpen := false
+	defer func() {
+		if !keepOpen {
+			f.Close()
 		}
+	}()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat file: %w", err)
+	}
+
+	header, err := parsePakHeader(f, stat.Size())
+	if err != nil {
+		return fmt.Errorf("could not load %s: %w", pakfile, err)
+	}
+	PakLogger.Debug("Pakfile layout", "name", pakfile, "variant", header.variant, "byteorder", header.order)
+
+	layer := a.addLayer(pakfile)
+
+	for i := range len(header.offsets) {
+		filename := header.names[i]
+		start, end := header.span(i)
 		if prefix != "" {
 			filename = fmt.Sprintf("%s/%s", prefix, filename)
 		}
 
-		a.assets[filename] = data
+		if lazy {
+			PakLogger.Debug("Indexing", "file", filename, "From", start, "To", end)
+			a.putLazy(layer, filename, int64(end-start), func() ([]byte, error) {
+				data, err := readSpan(f, start, end)
+				if err != nil {
+					return nil, fmt.Errorf("short read while unpacking %s from %s: %w", filename, pakfile, err)
+				}
+				return data, nil
+			})
+			continue
+		}
+
+		PakLogger.Debug("Extracting", "file", filename, "From", start, "To", end)
+		data, err := readSpan(f, start, end)
+		if err != nil {
+			return fmt.Errorf("short read while unpacking %s (position : %d): %w", filename, i, err)
+		}
+		a.put(layer, filename, data)
+	}
+
+	if lazy {
+		keepOpen = true
+		a.mu.Lock()
+		a.files = append(a.files, f)
+		a.mu.Unlock()
 	}
 	return nil
 }
 
+// Controls which files are picked up when sideloading a directory.
+// Patterns use path.Match syntax, ignore case and are tried against
+// both the name of a file and its path relative to the directory.
+type SideloadOptions struct {
+	Include []string // If not empty, only files matching one of these are loaded
+	Exclude []string // Files and directories matching any of these are skipped
+}
+
+// Files in asset directories that are never assets
+var DefaultSideloadExcludes = []string{".*", "README*", "Thumbs.db", "desktop.ini", "__MACOSX"}
+
+func matchesAny(patterns []string, name string, relPath string) bool {
+	name = strings.ToUpper(name)
+	relPath = strings.ToUpper(relPath)
+	for _, pattern := range patterns {
+		pattern = strings.ToUpper(pattern)
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks a slash separated path relative to the sideloaded directory
+// or zip file against the options, including the directories it's in
+func (o SideloadOptions) selects(relPath string) bool {
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		if matchesAny(o.Exclude, parts[i], strings.Join(parts[:i+1], "/")) {
+			return false
+		}
+	}
+	return len(o.Include) == 0 || matchesAny(o.Include, parts[len(parts)-1], relPath)
+}
+
+// Sideloads every file under baseDir except the ones in
+// DefaultSideloadExcludes
 func (a *Assets) LoadExtraAssets(baseDir string, prefix string) error {
-	assets, err := os.ReadDir(baseDir)
-	if err != nil {
+	return a.LoadExtraAssetsWithOptions(baseDir, prefix, SideloadOptions{Exclude: DefaultSideloadExcludes})
+}
+
+// Sideloads files under baseDir, including subdirectories. A file at
+// music/INTRO.MP3 under baseDir becomes the asset prefix/MUSIC/INTRO.MP3.
+// baseDir can also be a .zip file, which is treated like a directory.
+// Directories (but not zip files) are rescanned by Reload.
+func (a *Assets) LoadExtraAssetsWithOptions(baseDir string, prefix string, opts SideloadOptions) error {
+	if info, err := os.Stat(baseDir); err == nil && !info.IsDir() && strings.EqualFold(filepath.Ext(baseDir), ".zip") {
+		return a.loadZipAssets(baseDir, prefix, opts)
+	}
+	if _, err := os.ReadDir(baseDir); err != nil {
 		return fmt.Errorf("couldn't side load extra assets: Couldn't read %s", baseDir)
 	}
-	for _, asset := range assets {
-		assetFile := path.Join(baseDir, asset.Name())
+	rescan := func() (map[string]*assetEntry, error) {
+		return scanAssetDir(baseDir, prefix, opts)
+	}
+	entries, err := rescan()
+	if err != nil {
+		return err
+	}
+	layer := a.addLayer(baseDir)
+	a.mu.Lock()
+	layer.entries = entries
+	layer.rescan = rescan
+	a.mu.Unlock()
+	return nil
+}
+
+// Walks baseDir and returns lazily loaded entries for the files that
+// opts selects
+func scanAssetDir(baseDir string, prefix string, opts SideloadOptions) (map[string]*assetEntry, error) {
+	ret := make(map[string]*assetEntry)
+	err := filepath.WalkDir(baseDir, func(assetFile string, asset fs.DirEntry, err error) error {
+		if err != nil {
+			AssetsLogger.Warn("Could not load", "file", assetFile)
+			return err
+		}
+		relPath, err := filepath.Rel(baseDir, assetFile)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == "." {
+			return nil
+		}
+		if asset.IsDir() {
+			if matchesAny(opts.Exclude, asset.Name(), relPath) {
+				AssetsLogger.Debug("Skipping excluded", "file", assetFile)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !opts.selects(relPath) {
+			AssetsLogger.Debug("Skipping", "file", assetFile)
+			return nil
+		}
+
 		AssetsLogger.Debug("Sideloading", "file", assetFile)
-		key := asset.Name()
+		key := relPath
 		if prefix != "" {
 			key = fmt.Sprintf("%s/%s", prefix, key)
 		}
-		data, err := os.ReadFile(assetFile)
+		info, err := asset.Info()
 		if err != nil {
 			AssetsLogger.Warn("Could not load", "file", assetFile)
 			return err
 		}
-		key = strings.ToUpper(key)
-		a.assets[key] = data
+		ret[NormaliseName(key)] = &assetEntry{
+			open: func() ([]byte, error) {
+				return os.ReadFile(assetFile)
+			},
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return ret, nil
 }
 
-func (a *Assets) WriteAssetData(basedir string) {
-	os.Mkdir(basedir, 0755)
-
-	for name, data := range a.assets {
-		opfile := filepath.Join(basedir, name)
-		f, err := os.Create(opfile)
-
-		if err != nil {
+// Writes every asset into basedir. Prefixed assets go into
+// subdirectories.
+func (a *Assets) WriteAssetData(basedir string) error {
+	for _, name := range a.names() {
+		data, exists := a.lookup(name)
+		if !exists {
+			return fmt.Errorf("couldn't read %s", name)
+		}
+		opfile := filepath.Join(basedir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(opfile), 0755); err != nil {
+			return fmt.Errorf("couldn't create directory for %s: %w", name, err)
+		}
+		PakLogger.Debug("Writing", "name", name, "size", len(data))
+		if err := os.WriteFile(opfile, data, 0644); err != nil {
 			PakLogger.Error("Couldn't write", "name", name)
-		} else {
-			defer f.Close()
-			PakLogger.Debug("Writing", "name", name, "size", len(data))
-			f.Write(data)
+			return fmt.Errorf("couldn't write %s: %w", opfile, err)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,174 @@
+package formats
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Builds an archive of the given variant with one entry per name. The
+// data of the entries is cut out of content so some of them can be
+// empty.
+func synthesizePak(variant PakVariant, bigEndian bool, padding int, names []string, content []byte) *PakArchive {
+	archive := NewPakArchive()
+	archive.Variant = variant
+	archive.BigEndian = bigEndian
+	switch variant {
+	case PakPlain:
+		archive.Terminator = []byte{}
+	case PakSentinel:
+		archive.Terminator = []byte{0, 0, 0, 0, 0}
+	}
+	if variant != PakPlain {
+		archive.Terminator = append(archive.Terminator, make([]byte, padding)...)
+	}
+	for i, name := range names {
+		start := len(content) * i / len(names)
+		end := len(content) * (i + 1) / len(names)
+		archive.Entries = append(archive.Entries, PakEntry{Name: name, Data: content[start:end]})
+	}
+	return archive
+}
+
+func writePak(t *testing.T, archive *PakArchive) []byte {
+	var buf bytes.Buffer
+	if err := archive.Write(&buf); err != nil {
+		t.Fatalf("couldn't write %s archive: %v", archive.Variant, err)
+	}
+	return buf.Bytes()
+}
+
+// Checks that got has the same entries as want, in the same order
+func compareEntries(t *testing.T, want []PakEntry, got []PakEntry) {
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name {
+			t.Fatalf("entry %d is called %q, want %q", i, got[i].Name, want[i].Name)
+		}
+		if !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Fatalf("entry %d (%s) has %d bytes of different data, want %d", i, got[i].Name, len(got[i].Data), len(want[i].Data))
+		}
+	}
+}
+
+// Names of the entries in the seed archives. Each set is one archive.
+var pakSeedNames = [][]string{
+	{"A.CMP"},
+	{"WESTWOOD.CMP", "WESTWOOD.COL", "EMPTY"},
+	{"AA", "B", "LEVEL1.MAZ", "X.PAL", "Y"},
+}
+
+const pakSeedContent = "The quick brown fox jumps over the lazy dog"
+
+// Anything ParsePak accepts has to describe the bytes it was given and
+// write back out unchanged. Anything else has to be a *PakError.
+func FuzzParsePak(f *testing.F) {
+	for _, variant := range []PakVariant{PakPlain, PakZeroTerminated, PakSentinel, PakSized} {
+		for _, names := range pakSeedNames {
+			for _, bigEndian := range []bool{false, true} {
+				var buf bytes.Buffer
+				if err := synthesizePak(variant, bigEndian, 3, names, []byte(pakSeedContent)).Write(&buf); err != nil {
+					f.Fatal(err)
+				}
+				f.Add(buf.Bytes())
+			}
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parsed, err := ParsePak(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			var pakErr *PakError
+			if !errors.As(err, &pakErr) {
+				t.Fatalf("error isn't a *PakError: %v", err)
+			}
+			return
+		}
+		for _, entry := range parsed.Entries {
+			if !validPakName(entry.Name) {
+				t.Fatalf("accepted bad name %q", entry.Name)
+			}
+			if int(entry.Offset)+len(entry.Data) > len(data) || !bytes.Equal(entry.Data, data[entry.Offset:int(entry.Offset)+len(entry.Data)]) {
+				t.Fatalf("data of %s isn't what's at offset %d", entry.Name, entry.Offset)
+			}
+		}
+		rewritten := writePak(t, parsed)
+		if !bytes.Equal(rewritten, data) {
+			t.Fatalf("%s archive doesn't round trip", parsed.Variant)
+		}
+		reparsed, err := ParsePak(bytes.NewReader(rewritten), int64(len(rewritten)))
+		if err != nil {
+			t.Fatalf("rewritten archive doesn't parse: %v", err)
+		}
+		compareEntries(t, parsed.Entries, reparsed.Entries)
+	})
+}
+
+// Every archive Write produces has to parse back into the same entries
+// and layout
+func FuzzPakWrite(f *testing.F) {
+	for variant := range 4 {
+		for _, names := range pakSeedNames {
+			f.Add(byte(variant), variant == 1, byte(3), strings.Join(names, ","), []byte(pakSeedContent))
+		}
+	}
+	f.Fuzz(func(t *testing.T, variant byte, bigEndian bool, padding byte, names string, content []byte) {
+		archive := synthesizePak(PakVariant(variant%4), bigEndian, int(padding%8), strings.Split(names, ","), content)
+		var buf bytes.Buffer
+		if err := archive.Write(&buf); err != nil {
+			for _, entry := range archive.Entries {
+				if !validPakName(entry.Name) {
+					return
+				}
+			}
+			t.Fatalf("couldn't write %s archive: %v", archive.Variant, err)
+		}
+		data := buf.Bytes()
+
+		parsed, err := ParsePak(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("%s archive doesn't parse: %v", archive.Variant, err)
+		}
+		if parsed.Variant != archive.Variant || parsed.BigEndian != archive.BigEndian {
+			t.Fatalf("%s archive (big endian %v) parsed as %s (big endian %v)", archive.Variant, archive.BigEndian, parsed.Variant, parsed.BigEndian)
+		}
+		if archive.Variant == PakSentinel { // Write fills in the size
+			parsed.Terminator = parsed.Terminator[4:]
+			archive.Terminator = archive.Terminator[4:]
+		}
+		if !bytes.Equal(parsed.Terminator, archive.Terminator) {
+			t.Fatalf("terminator %v parsed as %v", archive.Terminator, parsed.Terminator)
+		}
+		compareEntries(t, archive.Entries, parsed.Entries)
+	})
+}
+
+func TestPakEmptyLastEntry(t *testing.T) {
+	for _, variant := range []PakVariant{PakPlain, PakZeroTerminated, PakSentinel, PakSized} {
+		t.Run(variant.String(), func(t *testing.T) {
+			archive := synthesizePak(variant, false, 0, []string{"A", "EMPTY"}, nil)
+			archive.Entries[0].Data = []byte("abc")
+			data := writePak(t, archive)
+			parsed, err := ParsePak(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Variant != variant {
+				t.Fatalf("parsed as %s", parsed.Variant)
+			}
+			compareEntries(t, archive.Entries, parsed.Entries)
+		})
+	}
+}
+
+func TestPakWriteBadNames(t *testing.T) {
+	for _, name := range []string{"", "CAF\xc9.CMP", "A\x00B", strings.Repeat("A", maxPakNameLength+1)} {
+		archive := NewPakArchive()
+		archive.Set(name, []byte("x"))
+		if err := archive.Write(&bytes.Buffer{}); err == nil {
+			t.Errorf("wrote entry called %q", name)
+		}
+	}
+}
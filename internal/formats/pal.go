@@ -1,36 +1,251 @@
 package formats
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image/color"
+	"strconv"
+	"strings"
 )
 
-func DecodePalette(data []byte) color.Palette {
-	ret := make(color.Palette, 256)
-	idx := 0
-	for i := 0; i < len(data); i += 3 {
-		r := data[i] & 0x3F
-		g := data[i+1] & 0x3F
-		b := data[i+2] & 0x3F
-		brightness := 3.0 // Scale up and apply brightness
-		brightR := int(float64(r) * brightness)
-		brightG := int(float64(g) * brightness)
-		brightB := int(float64(b) * brightness)
+// How the 6 bit values of the VGA DAC are scaled to 8 bits
+type PaletteConversion int
+
+const (
+	PaletteExact  PaletteConversion = iota // (v << 2) | (v >> 4). 0 and 63 map to 0 and 255 like real hardware
+	PaletteLinear                          // v * 255 / 63
+	PaletteLegacy                          // v * 3, what the engine used to do. 63 maps to 189
+)
+
+var ErrPaletteSize = errors.New("invalid palette size")
 
-		// Clamp to 255 max
-		if brightR > 255 {
-			brightR = 255
+func (c PaletteConversion) String() string {
+	switch c {
+	case PaletteExact:
+		return "exact"
+	case PaletteLinear:
+		return "linear"
+	case PaletteLegacy:
+		return "legacy"
+	}
+	return fmt.Sprintf("PaletteConversion(%d)", int(c))
+}
+
+// Parses the name of a conversion as returned by String
+func ParsePaletteConversion(name string) (PaletteConversion, error) {
+	for _, c := range []PaletteConversion{PaletteExact, PaletteLinear, PaletteLegacy} {
+		if c.String() == name {
+			return c, nil
 		}
-		if brightG > 255 {
-			brightG = 255
+	}
+	return PaletteExact, fmt.Errorf("unknown palette conversion %q. Use exact, linear or legacy", name)
+}
+
+// Scales a 6 bit DAC value to 8 bits. The top two bits are ignored like
+// the DAC does.
+func (c PaletteConversion) Scale(v uint8) uint8 {
+	v &= 0x3f
+	switch c {
+	case PaletteLinear:
+		return uint8(int(v) * 255 / 63)
+	case PaletteLegacy:
+		return v * 3
+	}
+	return v<<2 | v>>4
+}
+
+// Decodes a .COL/.PAL file of up to 256 RGB triples of 6 bit values.
+// The palette always has 256 colours and the ones the file doesn't set
+// are black.
+func DecodePaletteWith(data []byte, conversion PaletteConversion) (color.Palette, error) {
+	if len(data)%3 != 0 || len(data) > 256*3 {
+		return nil, fmt.Errorf("%w: %d bytes is not up to 256 RGB triples", ErrPaletteSize, len(data))
+	}
+	ret := make(color.Palette, 256)
+	for idx := range ret {
+		if idx*3 >= len(data) {
+			ret[idx] = color.RGBA{0, 0, 0, 255}
+			continue
 		}
-		if brightB > 255 {
-			brightB = 255
+		ret[idx] = color.RGBA{
+			conversion.Scale(data[idx*3]),
+			conversion.Scale(data[idx*3+1]),
+			conversion.Scale(data[idx*3+2]),
+			255,
 		}
+	}
+	PalLogger.Debug("Palette created", "colours", len(data)/3, "conversion", conversion)
+	return ret, nil
+}
+
+// Decodes a palette with the exact conversion. Trailing bytes that
+// don't make up a colour, and anything past 256 colours, are ignored.
+func DecodePalette(data []byte) color.Palette {
+	usable := min(len(data)-len(data)%3, 256*3)
+	if usable != len(data) {
+		PalLogger.Warn("Ignoring bytes past the end of the palette", "length", len(data), "used", usable)
+	}
+	ret, _ := DecodePaletteWith(data[:usable], PaletteExact)
+	return ret
+}
+
+// Turns an 8 bit value back into 6 bits. The inverse of Scale for values
+// Scale can produce.
+func (c PaletteConversion) Unscale(v uint8) uint8 {
+	switch c {
+	case PaletteLinear:
+		return uint8((int(v)*63 + 127) / 255)
+	case PaletteLegacy:
+		return min(v/3, 63)
+	}
+	return v >> 2
+}
 
-		ret[idx] = color.RGBA{uint8(brightR), uint8(brightG), uint8(brightB), 255}
-		idx += 1
+// Writes p as a VGA .COL/.PAL file of 6 bit RGB triples
+func EncodePalette(p color.Palette, conversion PaletteConversion) []byte {
+	ret := make([]byte, 0, len(p)*3)
+	for _, c := range p {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		ret = append(ret, conversion.Unscale(rgba.R), conversion.Unscale(rgba.G), conversion.Unscale(rgba.B))
 	}
-	PalLogger.Debug("Palette created")
 	return ret
+}
 
+var ErrPaletteFormat = errors.New("invalid palette file")
+
+// Parses the colour lines shared by the text formats. Each has three
+// numbers from 0 to 255 and may be followed by a name.
+func parsePaletteLines(lines []string, format string) (color.Palette, error) {
+	ret := color.Palette{}
+	for n, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%w: %s line %d: %q", ErrPaletteFormat, format, n+1, line)
+		}
+		var rgb [3]uint8
+		for i := range rgb {
+			v, err := strconv.ParseUint(fields[i], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s line %d: %v", ErrPaletteFormat, format, n+1, err)
+			}
+			rgb[i] = uint8(v)
+		}
+		ret = append(ret, color.RGBA{rgb[0], rgb[1], rgb[2], 255})
+	}
+	if len(ret) > 256 {
+		return nil, fmt.Errorf("%w: %s palette has %d colours", ErrPaletteSize, format, len(ret))
+	}
+	return ret, nil
+}
+
+func splitLines(data []byte) []string {
+	return strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+}
+
+// Decodes a Paint Shop Pro (JASC-PAL) palette
+func DecodeJASCPalette(data []byte) (color.Palette, error) {
+	lines := splitLines(data)
+	if len(lines) < 3 || strings.TrimSpace(lines[0]) != "JASC-PAL" {
+		return nil, fmt.Errorf("%w: no JASC-PAL header", ErrPaletteFormat)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(lines[2]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: JASC-PAL colour count: %v", ErrPaletteFormat, err)
+	}
+	ret, err := parsePaletteLines(lines[3:], "JASC-PAL")
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) != count {
+		return nil, fmt.Errorf("%w: JASC-PAL header says %d colours but has %d", ErrPaletteFormat, count, len(ret))
+	}
+	return ret, nil
+}
+
+// Writes p as a Paint Shop Pro (JASC-PAL) palette
+func EncodeJASCPalette(p color.Palette) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "JASC-PAL\r\n0100\r\n%d\r\n", len(p))
+	for _, c := range p {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		fmt.Fprintf(&b, "%d %d %d\r\n", rgba.R, rgba.G, rgba.B)
+	}
+	return []byte(b.String())
+}
+
+// Decodes a GIMP (.gpl) palette
+func DecodeGIMPPalette(data []byte) (color.Palette, error) {
+	lines := splitLines(data)
+	if strings.TrimSpace(lines[0]) != "GIMP Palette" {
+		return nil, fmt.Errorf("%w: no GIMP Palette header", ErrPaletteFormat)
+	}
+	colours := []string{}
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "Name:") || strings.HasPrefix(trimmed, "Columns:") {
+			colours = append(colours, "")
+			continue
+		}
+		colours = append(colours, line)
+	}
+	return parsePaletteLines(colours, "GIMP")
+}
+
+// Writes p as a GIMP (.gpl) palette called name. Colours are named
+// after their index so they're easy to find when painting.
+func EncodeGIMPPalette(p color.Palette, name string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "GIMP Palette\nName: %s\nColumns: 16\n#\n", name)
+	for i, c := range p {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		fmt.Fprintf(&b, "%3d %3d %3d\tIndex %d\n", rgba.R, rgba.G, rgba.B, i)
+	}
+	return []byte(b.String())
+}
+
+// Decodes an Adobe colour table (.act). These are 256 8 bit RGB triples,
+// optionally followed by big endian colour count and transparent index.
+func DecodeACTPalette(data []byte) (color.Palette, error) {
+	if len(data) != 768 && len(data) != 772 {
+		return nil, fmt.Errorf("%w: ACT files are 768 or 772 bytes, not %d", ErrPaletteSize, len(data))
+	}
+	count, transparent := 256, -1
+	if len(data) == 772 {
+		count = int(binary.BigEndian.Uint16(data[768:770]))
+		if t := binary.BigEndian.Uint16(data[770:772]); t != 0xffff {
+			transparent = int(t)
+		}
+		if count == 0 || count > 256 {
+			count = 256
+		}
+	}
+	ret := make(color.Palette, count)
+	for i := range ret {
+		ret[i] = color.RGBA{data[i*3], data[i*3+1], data[i*3+2], 255}
+	}
+	if transparent >= 0 && transparent < count {
+		ret[transparent] = color.RGBA{}
+	}
+	return ret, nil
+}
+
+// Writes p as an Adobe colour table (.act). The trailer records the
+// colour count and the first fully transparent entry, if any.
+func EncodeACTPalette(p color.Palette) []byte {
+	ret := make([]byte, 772)
+	transparent := 0xffff
+	for i, c := range p[:min(len(p), 256)] {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		if rgba.A == 0 && transparent == 0xffff {
+			transparent = i
+		}
+		ret[i*3], ret[i*3+1], ret[i*3+2] = rgba.R, rgba.G, rgba.B
+	}
+	binary.BigEndian.PutUint16(ret[768:770], uint16(min(len(p), 256)))
+	binary.BigEndian.PutUint16(ret[770:772], uint16(transparent))
+	return ret
 }
@@ -0,0 +1,146 @@
+package formats
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Name given to the palette embedded in a CPS file when matching
+const EmbeddedPaletteName = "(embedded)"
+
+// How well a palette suits an image. Scores run from 0 to 1 and higher
+// is better.
+type PaletteMatch struct {
+	Name       string
+	Score      float64 // Weighted combination of the others
+	Smoothness float64 // How close the colours of neighbouring pixels are
+	Coverage   float64 // Share of the pixels whose index has a colour rather than unused black
+}
+
+// What matching needs to know about an image: how often each index is
+// used and how often two different indices sit next to each other
+type paletteProfile struct {
+	counts [256]int
+	pairs  map[[2]uint8]int
+}
+
+const maxColourDistance = 441.6729559300637 // Between black and white
+
+func newPaletteProfile(pixels []byte, width int) *paletteProfile {
+	ret := &paletteProfile{pairs: make(map[[2]uint8]int)}
+	for i, p := range pixels {
+		ret.counts[p]++
+		// Pairs of the same index look the same under any palette so
+		// they're left out
+		if i%width+1 < width && i+1 < len(pixels) && pixels[i+1] != p {
+			q := pixels[i+1]
+			ret.pairs[[2]uint8{min(p, q), max(p, q)}]++
+		}
+		if i+width < len(pixels) && pixels[i+width] != p {
+			q := pixels[i+width]
+			ret.pairs[[2]uint8{min(p, q), max(p, q)}]++
+		}
+	}
+	return ret
+}
+
+func colourDistance(a, b color.Color) float64 {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	dr := float64(ar>>8) - float64(br>>8)
+	dg := float64(ag>>8) - float64(bg>>8)
+	db := float64(ab>>8) - float64(bb>>8)
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
+
+func (p *paletteProfile) score(name string, palette color.Palette) PaletteMatch {
+	at := func(i uint8) color.Color {
+		if int(i) < len(palette) {
+			return palette[i]
+		}
+		return color.Black
+	}
+
+	distance, pairs := 0.0, 0
+	for pair, n := range p.pairs {
+		distance += colourDistance(at(pair[0]), at(pair[1])) * float64(n)
+		pairs += n
+	}
+	smoothness := 1.0
+	if pairs != 0 {
+		smoothness = 1 - distance/float64(pairs)/maxColourDistance
+	}
+
+	// Index 0 is usually transparent or the background so it doesn't
+	// say anything about the palette
+	coloured, used := 0, 0
+	for i, n := range p.counts[1:] {
+		used += n
+		if r, g, b, _ := at(uint8(i + 1)).RGBA(); r|g|b != 0 {
+			coloured += n
+		}
+	}
+	coverage := 1.0
+	if used != 0 {
+		coverage = float64(coloured) / float64(used)
+	}
+
+	return PaletteMatch{
+		Name:       name,
+		Score:      0.6*smoothness + 0.4*coverage,
+		Smoothness: smoothness,
+		Coverage:   coverage,
+	}
+}
+
+// Scores every palette against an image of the given width and returns
+// them best first
+func MatchPalettes(pixels []byte, width int, palettes map[string]color.Palette) []PaletteMatch {
+	profile := newPaletteProfile(pixels, width)
+	ret := make([]PaletteMatch, 0, len(palettes))
+	for name, palette := range palettes {
+		ret = append(ret, profile.score(name, palette))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Score != ret[j].Score {
+			return ret[i].Score > ret[j].Score
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Ranks the .COL and .PAL palettes in the assets, and the embedded
+// palette if there is one, by how likely they are to go with the CMP
+// or CPS image name
+func (a *Assets) MatchPalettes(name string) ([]PaletteMatch, error) {
+	data, exists := a.lookup(name)
+	if !exists {
+		return nil, fmt.Errorf("cannot fetch %s: No such asset", name)
+	}
+	decoded, err := DecodeCps(data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode image %s: %w", name, err)
+	}
+	palettes := make(map[string]color.Palette)
+	if decoded.Palette != nil {
+		palettes[EmbeddedPaletteName] = decoded.Palette
+	}
+	for _, candidate := range a.names() {
+		ext := strings.ToLower(path.Ext(candidate))
+		if ext != ".col" && ext != ".pal" {
+			continue
+		}
+		palette, err := a.GetPalette(candidate)
+		if err != nil {
+			AssetsLogger.Debug("Skipping palette", "name", candidate, "error", err)
+			continue
+		}
+		palettes[candidate] = palette
+	}
+	return MatchPalettes(decoded.Pixels, cpsWidth, palettes), nil
+}
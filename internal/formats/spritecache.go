@@ -0,0 +1,64 @@
+package formats
+
+import "sync"
+
+type spriteKey struct {
+	name    string
+	palette string
+	width   uint
+	height  uint
+	opts    SpriteOptions
+}
+
+// Decoded sprites by the arguments they were loaded with. Safe for
+// concurrent use. generation goes up on every invalidation so a sprite
+// decoded from data that changed in the meantime isn't added.
+type spriteCache struct {
+	mu         sync.Mutex
+	sprites    map[spriteKey]*Sprite
+	generation uint64
+}
+
+// Returns the cached sprite, if any, and the generation to pass to add
+// if it has to be decoded
+func (c *spriteCache) get(key spriteKey) (*Sprite, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sprites[key], c.generation
+}
+
+// Caches sprite unless the cache was invalidated after generation was
+// returned by get
+func (c *spriteCache) add(key spriteKey, sprite *Sprite, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		AssetsLogger.Debug("Not caching sprite decoded before an invalidation", "name", key.name, "palette", key.palette)
+		return
+	}
+	if c.sprites == nil {
+		c.sprites = make(map[spriteKey]*Sprite)
+	}
+	c.sprites[key] = sprite
+}
+
+// Drops sprites made from any of names, or everything if there are none
+func (c *spriteCache) invalidate(names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation += 1
+	if len(names) == 0 {
+		clear(c.sprites)
+		return
+	}
+	drop := make(map[string]bool, len(names))
+	for _, name := range names {
+		drop[NormaliseName(name)] = true
+	}
+	for key := range c.sprites {
+		if drop[key.name] || drop[key.palette] {
+			AssetsLogger.Debug("Dropping cached sprite", "name", key.name, "palette", key.palette)
+			delete(c.sprites, key)
+		}
+	}
+}
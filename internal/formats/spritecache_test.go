@@ -0,0 +1,79 @@
+package formats
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpriteCacheGeneration(t *testing.T) {
+	var cache spriteCache
+	key := spriteKey{name: "A.CPS", palette: "A.PAL"}
+	sprite := &Sprite{name: "A.CPS"}
+
+	_, generation := cache.get(key)
+	cache.invalidate("B.CPS") // While A.CPS is being decoded
+	cache.add(key, sprite, generation)
+	if cached, _ := cache.get(key); cached != nil {
+		t.Fatal("sprite decoded before an invalidation was cached")
+	}
+
+	_, generation = cache.get(key)
+	cache.add(key, sprite, generation)
+	if cached, _ := cache.get(key); cached != sprite {
+		t.Fatal("sprite wasn't cached")
+	}
+	cache.invalidate("a.pal")
+	if cached, _ := cache.get(key); cached != nil {
+		t.Fatal("sprite wasn't dropped with its palette")
+	}
+}
+
+// A sprite whose data changes while it's being decoded mustn't stay
+// cached once the change has been seen
+func TestSpriteCacheInvalidatedWhileDecoding(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "old.png"), color.Black, time.Now())
+	writePNG(t, filepath.Join(dir, "new.png"), color.White, time.Now())
+	oldData, err := os.ReadFile(filepath.Join(dir, "old.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newData, err := os.ReadFile(filepath.Join(dir, "new.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAssets()
+	layer := a.addLayer("test")
+	reading := make(chan bool)
+	proceed := make(chan bool)
+	a.putLazy(layer, "SPRITE.PNG", int64(len(oldData)), func() ([]byte, error) {
+		reading <- true
+		<-proceed
+		return oldData, nil
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := a.GetSprite("SPRITE.PNG", "", 2, 2, "")
+		done <- err
+	}()
+	<-reading
+	a.InvalidateSprites("SPRITE.PNG") // What Reload does once it's seen the change
+	proceed <- true
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	a.put(layer, "SPRITE.PNG", newData)
+	sprite, err := a.GetSprite("SPRITE.PNG", "", 2, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.GrayModel.Convert(sprite.Image.At(0, 0)).(color.Gray); got.Y != 0xff {
+		t.Fatalf("got a sprite decoded before the invalidation: %v", got)
+	}
+}
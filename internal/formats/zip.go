@@ -0,0 +1,51 @@
+package formats
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Sideloads the files in a zip archive the same way a directory would
+// be. The archive stays open and files are decompressed the first time
+// they're used.
+func (a *Assets) loadZipAssets(zipFile string, prefix string, opts SideloadOptions) error {
+	AssetsLogger.Info("Loading zip file", "name", zipFile)
+	r, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return fmt.Errorf("couldn't side load extra assets: Couldn't read %s: %w", zipFile, err)
+	}
+	layer := a.addLayer(zipFile)
+
+	for _, f := range r.File {
+		relPath := strings.TrimPrefix(path.Clean(strings.ReplaceAll(f.Name, "\\", "/")), "/")
+		if f.FileInfo().IsDir() || relPath == "." {
+			continue
+		}
+		if !opts.selects(relPath) {
+			AssetsLogger.Debug("Skipping", "file", f.Name, "zip", zipFile)
+			continue
+		}
+
+		AssetsLogger.Debug("Sideloading", "file", f.Name, "zip", zipFile)
+		key := relPath
+		if prefix != "" {
+			key = fmt.Sprintf("%s/%s", prefix, key)
+		}
+		a.putLazy(layer, key, int64(f.UncompressedSize64), func() ([]byte, error) {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("couldn't open %s in %s: %w", f.Name, zipFile, err)
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		})
+	}
+
+	a.mu.Lock()
+	a.files = append(a.files, r)
+	a.mu.Unlock()
+	return nil
+}